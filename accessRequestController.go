@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const maxAccessRequestMessageLength = 500
+
+// accessRequestRow is a pending request as listed on the board details page.
+type accessRequestRow struct {
+	ID       uint
+	Username string
+	Message  string
+}
+
+func (env *Env) hasPendingAccessRequest(user User, board Board) bool {
+	var pending int64
+	env.db.Model(&AccessRequest{}).Where("board_id = ? AND user_id = ? AND status = ?", board.ID, user.ID, AccessRequestPending).Count(&pending)
+	return pending > 0
+}
+
+func (env *Env) pendingAccessRequests(board Board) []accessRequestRow {
+	requests := []accessRequestRow{}
+	env.db.Model(&AccessRequest{}).
+		Select("access_requests.id, users.username, access_requests.message").
+		Joins("JOIN users ON users.id = access_requests.user_id").
+		Where("access_requests.board_id = ? AND access_requests.status = ?", board.ID, AccessRequestPending).
+		Order("access_requests.created_at").
+		Scan(&requests)
+	return requests
+}
+
+// RequestBoardAccess asks the owners of a board the user can't open to let
+// them in. Asking again while a request is pending just updates its message.
+func (env *Env) RequestBoardAccess(c *gin.Context) {
+	user := currentUser(c)
+	board, _, status, err := env.authorizeBoard(user, c.Param("boardId"))
+	if err == nil {
+		// Already a member, nothing to ask for
+		c.Redirect(http.StatusFound, fmt.Sprintf("/?boardId=%d", board.ID))
+		return
+	}
+	if status != http.StatusForbidden {
+		http.Error(c.Writer, boardErrorMessage(status), status)
+		return
+	}
+
+	message := strings.TrimSpace(c.PostForm("message"))
+	if utf8.RuneCountInString(message) > maxAccessRequestMessageLength {
+		http.Error(c.Writer, fmt.Sprintf("Message must be at most %d characters", maxAccessRequestMessageLength), http.StatusBadRequest)
+		return
+	}
+
+	result := env.db.Model(&AccessRequest{}).
+		Where("board_id = ? AND user_id = ? AND status = ?", board.ID, user.ID, AccessRequestPending).
+		Update("message", message)
+	if result.Error == nil && result.RowsAffected == 0 {
+		accessRequest := AccessRequest{BoardID: board.ID, UserID: user.ID, Message: message, Status: AccessRequestPending}
+		result = env.db.Create(&accessRequest)
+	}
+	if result.Error != nil {
+		log.Printf("Could not request access to board %d for user %d: %v", board.ID, user.ID, result.Error)
+		http.Error(c.Writer, "Could not request access", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d requested access to board %d", user.ID, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/?boardId=%d", board.ID))
+}
+
+// ApproveAccessRequest makes the requester a member with the chosen role,
+// editor by default.
+func (env *Env) ApproveAccessRequest(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	requestId, err := strconv.Atoi(c.Params.ByName("requestId"))
+	if err != nil {
+		http.Error(c.Writer, "Access request not found", http.StatusNotFound)
+		return
+	}
+	role := c.DefaultPostForm("role", RoleEditor)
+	if !isValidRole(role) {
+		http.Error(c.Writer, fmt.Sprintf("Invalid role %s", role), http.StatusBadRequest)
+		return
+	}
+
+	accessRequest := AccessRequest{}
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND board_id = ? AND status = ?", requestId, board.ID, AccessRequestPending).
+			First(&accessRequest).Error
+		if err != nil {
+			return err
+		}
+
+		boardMember := BoardMember{BoardID: board.ID, UserID: accessRequest.UserID, Role: role}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&boardMember).Error; err != nil {
+			return err
+		}
+		return tx.Model(&accessRequest).Updates(map[string]interface{}{"status": AccessRequestApproved, "decided_by_id": user.ID}).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(c.Writer, "Access request not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Could not approve access request %d for board %d: %v", requestId, board.ID, err)
+		http.Error(c.Writer, "Could not approve access request", http.StatusInternalServerError)
+		return
+	}
+
+	env.membershipChanged(board.ID, accessRequest.UserID)
+	log.Printf("User %d approved access request %d for board %d as %s", user.ID, accessRequest.ID, board.ID, role)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) DenyAccessRequest(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	requestId := c.Params.ByName("requestId")
+
+	result := env.db.Model(&AccessRequest{}).
+		Where("id = ? AND board_id = ? AND status = ?", requestId, board.ID, AccessRequestPending).
+		Updates(map[string]interface{}{"status": AccessRequestDenied, "decided_by_id": user.ID})
+	if result.Error != nil {
+		log.Printf("Could not deny access request %s for board %d: %v", requestId, board.ID, result.Error)
+		http.Error(c.Writer, "Could not deny access request", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(c.Writer, "Access request not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("User %d denied access request %s for board %d", user.ID, requestId, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
@@ -5,262 +5,633 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 
+// AddUserToBoard invites a user to the board. They become a member once they
+// accept the invitation from their user page.
 func (env *Env) AddUserToBoard(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
-	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+	board := currentBoard(c)
+	user := currentUser(c)
+	// Get user id from form post
+	usernameToAdd := c.PostForm("userToAdd")
+	role := c.DefaultPostForm("role", RoleEditor)
+	if !isValidRole(role) {
+		http.Error(c.Writer, fmt.Sprintf("Invalid role %s", role), http.StatusBadRequest)
 		return
 	}
-	user, err := env.getUserFromSession(sessionId)
+
+	userToAdd := User{}
+	err := env.db.First(&userToAdd, "username = ?", usernameToAdd).Error
 	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+		http.Error(c.Writer, fmt.Sprintf("No user called %s", usernameToAdd), http.StatusNotFound)
+		return
+	}
+	var existingMembers int64
+	env.db.Model(&BoardMember{}).Where("board_id = ? AND user_id = ?", board.ID, userToAdd.ID).Count(&existingMembers)
+	// Check if user is already a member
+	if existingMembers > 0 {
+		log.Printf("User %d is already a member of board %d", userToAdd.ID, board.ID)
+		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
 		return
 	}
-	// Check if requesting user is member of the board
-
-	boardMember := BoardMember{}
-
-	// TODO: handle this err
-	boardId, err := strconv.Atoi(c.Params.ByName("boardId"))
-
-	// TODO: Check if there's a result from this if the query fails
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, user.ID)
-
-	if boardMember.BoardID == 0 {
-		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
 
-		if err != nil {
-			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
-		}
+	err = env.inviteUserToBoard(board, user, userToAdd, role)
+	if err != nil {
+		log.Printf("Could not invite user %d to board %d: %v", userToAdd.ID, board.ID, err)
+		http.Error(c.Writer, "Could not invite user", http.StatusInternalServerError)
 		return
 	}
+	log.Printf("Invited user %d to board %d as %s", userToAdd.ID, board.ID, role)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) RemoveUserFromBoard(c *gin.Context) {
+	board := currentBoard(c)
 	// Get user id from form post
 	// TODO: handle this err
-	usernameToAdd := c.PostForm("userToAdd")
+	usernameToRemove := c.PostForm("userToRemove")
 	
 
-	userToAdd := User{}
-	// TODO: If a user can't be found, user ID 0 will be added to the boardMember FIX
-	env.db.First(&userToAdd, "username = ?", usernameToAdd)
-	boardMember = BoardMember{}
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, userToAdd.ID)
-	// Check if user is already a member
-	if boardMember.BoardID == 0 {
-		// Create board member
-		
-		BoardMember := BoardMember{BoardID: uint(boardId), UserID: userToAdd.ID}
+	userToRemove := User{}
+	env.db.First(&userToRemove, "username = ?", usernameToRemove)
+
+	boardMember := BoardMember{}
+	env.db.First(&boardMember, "board_id = ? AND user_id = ?", board.ID, userToRemove.ID)
+
+	log.Printf("Board member is %d, and %d", boardMember.BoardID, boardMember.UserID)
+	if boardMember.BoardID != 0 {
+		if boardMember.Role == RoleOwner && env.countBoardOwners(board.ID) <= 1 {
+			http.Error(c.Writer, "Can't remove the board's only owner", http.StatusConflict)
+			return
+		}
 		// TODO: Check for errors
-		env.db.Create(&BoardMember)
-		log.Printf("Added user %d to board %d", userToAdd.ID, boardId)
-		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", boardId))
+		env.db.Unscoped().Delete(&boardMember)
+		env.membershipChanged(board.ID, userToRemove.ID)
+		log.Printf("Removed user %d from board %d", userToRemove.ID, board.ID)
+		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/members", board.ID))
 		return
 	} else {
-		log.Printf("User %d is already a member of board %d", userToAdd.ID, boardId)
+		log.Printf("User %d was not a member of of board %d", userToRemove.ID, board.ID)
+		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/members", board.ID))
+		return
 	}
 }
 
-func (env *Env) RemoveUserFromBoard(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
-	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+func (env *Env) ChangeMemberRole(c *gin.Context) {
+	board := currentBoard(c)
+	username := c.PostForm("username")
+	role := c.PostForm("role")
+	if !isValidRole(role) {
+		http.Error(c.Writer, fmt.Sprintf("Invalid role %s", role), http.StatusBadRequest)
 		return
 	}
-	user, err := env.getUserFromSession(sessionId)
+
+	member := User{}
+	boardMember := BoardMember{}
+	err := env.db.First(&member, "username = ?", username).Error
+	if err == nil {
+		err = env.db.First(&boardMember, "board_id = ? AND user_id = ?", board.ID, member.ID).Error
+	}
 	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+		http.Error(c.Writer, fmt.Sprintf("%s is not a member of this board", username), http.StatusNotFound)
 		return
 	}
-	// Check if requesting user is member of the board
 
-	boardMember := BoardMember{}
+	if boardMember.Role == RoleOwner && role != RoleOwner && env.countBoardOwners(board.ID) <= 1 {
+		http.Error(c.Writer, "Can't demote the board's only owner", http.StatusConflict)
+		return
+	}
 
-	// TODO: handle this err
-	boardId, err := strconv.Atoi(c.Params.ByName("boardId"))
+	err = env.db.Model(&boardMember).Update("role", role).Error
+	if err != nil {
+		log.Printf("Could not change role of user %d on board %d: %v", member.ID, board.ID, err)
+		http.Error(c.Writer, "Could not change role", http.StatusInternalServerError)
+		return
+	}
+	env.membershipChanged(board.ID, member.ID)
+	log.Printf("User %d is now %s of board %d", member.ID, role, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/members", board.ID))
+}
 
-	// TODO: Check if there's a result from this if the query fails
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, user.ID)
+func (env *Env) countBoardOwners(boardId uint) int64 {
+	var owners int64
+	env.db.Model(&BoardMember{}).Where("board_id = ? AND role = ?", boardId, RoleOwner).Count(&owners)
+	return owners
+}
 
-	if boardMember.BoardID == 0 {
-		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
+// PostBoard creates a board owned by the signed in user, starting from the
+// templateId template if there is one.
+func (env *Env) PostBoard(c *gin.Context) {
+	user := currentUser(c)
 
+	board := Board{}
+	template := Board{}
+	if rawTemplateId := c.PostForm("templateId"); rawTemplateId != "" {
+		templateId, err := strconv.Atoi(rawTemplateId)
+		if err == nil {
+			err = env.visibleTemplates(user).Where("boards.id = ?", templateId).First(&template).Error
+		}
 		if err != nil {
-			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+			http.Error(c.Writer, "Template not found", http.StatusNotFound)
+			return
+		}
+		board = Board{
+			BoardName:        template.BoardName,
+			Description:      template.Description,
+			BackgroundColour: template.BackgroundColour,
+			GridStyle:        template.GridStyle,
+			StrokeColour:     template.StrokeColour,
+			StrokeWidth:      template.StrokeWidth,
+		}
+	}
+
+	if boardName := c.PostForm("boardName"); boardName != "" || template.ID == 0 {
+		var err error
+		board.BoardName, err = validateBoardName(boardName)
+		if err != nil {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&board).Error; err != nil {
+			return err
+		}
+		if template.ID != 0 {
+			if _, err := copyBoardLines(tx, template.ID, board.ID); err != nil {
+				return err
+			}
 		}
+		return tx.Create(&BoardMember{BoardID: board.ID, UserID: user.ID, Role: RoleOwner}).Error
+	})
+	if err != nil {
+		log.Printf("Could not create board %s: %v", board.BoardName, err)
+		http.Error(c.Writer, "Could not create board", http.StatusInternalServerError)
 		return
 	}
-	// Get user id from form post
-	// TODO: handle this err
-	usernameToRemove := c.PostForm("userToRemove")
-	
+	log.Printf("New board created %d with name %s", board.ID, board.BoardName)
+	env.memberships.invalidate(board.ID, user.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("?boardId=%d", board.ID))
+}
 
-	userToRemove := User{}
-	env.db.First(&userToRemove, "username = ?", usernameToRemove)
+func (env *Env) NewBoard(c *gin.Context) {
+	templateVars := map[string]interface{}{"templates": env.templatesForUser(currentUser(c))}
+	err := templates.ExecuteTemplate(c.Writer, "newBoard.html", templateVars)
 
-	boardMember = BoardMember{}
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, userToRemove.ID)
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	log.Printf("Board member is %d, and %d", boardMember.BoardID, boardMember.UserID)
-	if boardMember.BoardID != 0 {
-		// TODO: Check for errors
-		env.db.Delete(&boardMember)
-		log.Printf("Removed user %d from board %d", userToRemove.ID, boardId)
-		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/members", boardId))
+// boardTeamGrantRow is a team with access to a board, as listed on the
+// board's page.
+type boardTeamGrantRow struct {
+	ID   uint
+	Name string
+	Role string
+}
+
+func (env *Env) GetBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	log.Printf("Boardname %s id %d\n", board.BoardName, board.ID)
+	log.Printf("=========================")
+
+	teamGrants := []boardTeamGrantRow{}
+	env.db.Model(&BoardTeamGrant{}).Select("teams.id, teams.name, board_team_grants.role").Joins("JOIN teams ON teams.id = board_team_grants.team_id").Where("board_team_grants.board_id = ?", board.ID).Order("teams.name").Scan(&teamGrants)
+
+	isOwner := currentBoardRole(c) == RoleOwner
+	templateVars := map[string]interface{}{
+		"board":      board,
+		"isOwner":    isOwner,
+		"roles":      roles,
+		"gridStyles": gridStyles,
+		"host":       c.Request.Host,
+		"teamGrants": teamGrants,
+		"userTeams":  env.teamsForUser(user),
+		"tags":       env.tagsForBoard(board),
+		"canTag":     roleCanDraw(currentBoardRole(c)),
+		"folders":    env.foldersForUser(user),
+		"inFolders":  env.boardFoldersForUser(user, board),
+	}
+	if isOwner {
+		templateVars["accessRequests"] = env.pendingAccessRequests(board)
+	}
+	err := templates.ExecuteTemplate(c.Writer, "boardDetails.html", templateVars)
+
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ShareBoard turns on the board's public read only link, or replaces it so
+// the old link stops working.
+func (env *Env) ShareBoard(c *gin.Context) {
+	board := currentBoard(c)
+	token, err := newRandomToken()
+	if err != nil {
+		log.Printf("Could not generate share token: %v", err)
+		http.Error(c.Writer, "Could not share board", http.StatusInternalServerError)
 		return
-	} else {
-		log.Printf("User %d was not a member of of board %d", userToRemove.ID, boardId)
-		c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/members", boardId))
+	}
+	err = env.db.Model(&board).Update("share_token", token).Error
+	if err != nil {
+		log.Printf("Could not share board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not share board", http.StatusInternalServerError)
 		return
 	}
+	env.hubs.closeAnonymous(int(board.ID), closeCodeShareLinkRevoked, "This share link has been replaced")
+	log.Printf("Board %d is now shared", board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
 }
 
-func (env *Env) PostBoard(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
+func (env *Env) UnshareBoard(c *gin.Context) {
+	board := currentBoard(c)
+	err := env.db.Model(&board).Update("share_token", nil).Error
 	if err != nil {
-		panic(err)
+		log.Printf("Could not unshare board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not unshare board", http.StatusInternalServerError)
+		return
 	}
-	user, err := env.getUserFromSession(sessionId)
+	env.hubs.closeAnonymous(int(board.ID), closeCodeShareLinkRevoked, "This board is no longer shared")
+	log.Printf("Board %d is no longer shared", board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+// DeleteBoard soft deletes the board along with its lines, memberships and
+// invites, and disconnects anyone drawing on it. Everything gets the same
+// deleted_at so the board can be restored as it was.
+func (env *Env) DeleteBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	now := time.Now()
+
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the board before its lines, in the same order as savePoints, so
+		// points being saved either finish first and go in the trash with it
+		// or find it deleted
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Board{}, board.ID).Error; err != nil {
+			return err
+		}
+		for _, model := range boardScopedModels {
+			softDelete, err := softDeletable(tx, model)
+			if err != nil {
+				return err
+			}
+			if !softDelete {
+				continue
+			}
+			if err := tx.Model(model).Where("board_id = ?", board.ID).Update("deleted_at", now).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&board).Update("deleted_at", now).Error
+	})
 	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+		log.Printf("Could not delete board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not delete board", http.StatusInternalServerError)
 		return
 	}
 
-	boardName := c.PostForm("boardName")
-	board := Board{BoardName: boardName}
-	// TODO: Check for errors
-	env.db.Create(&board)
-	log.Printf("New board created %d with name %s", board.ID, board.BoardName)
-	BoardMember := BoardMember{BoardID: board.ID, UserID: user.ID}
-	// TODO: Check for errors
-	env.db.Create(&BoardMember)
-	c.Redirect(http.StatusFound, fmt.Sprintf("?boardId=%d", board.ID))
+	env.memberships.invalidateBoard(board.ID)
+	env.hubs.close(int(board.ID), closeCodeBoardDeleted, "Board was deleted")
+	log.Printf("User %d deleted board %d", user.ID, board.ID)
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"deleted": board.ID})
+		return
+	}
+	c.Redirect(http.StatusSeeOther, "/boards")
 }
 
-func (env *Env) NewBoard(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
-	if err != nil {
-		panic(err)
+// TransferBoardOwnership makes another member the owner, and the current
+// owner an editor.
+func (env *Env) TransferBoardOwnership(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	newOwnerUsername := c.PostForm("newOwner")
+
+	newOwner := User{}
+	newOwnerMember := BoardMember{}
+	err := env.db.First(&newOwner, "username = ?", newOwnerUsername).Error
+	if err == nil {
+		err = env.db.First(&newOwnerMember, "board_id = ? AND user_id = ?", board.ID, newOwner.ID).Error
 	}
-	_, err = env.getUserFromSession(sessionId)
 	if err != nil {
-		// TODO: Doesn't redirect due to turbo
-		c.Redirect(http.StatusFound, "/signin")
+		http.Error(c.Writer, fmt.Sprintf("%s is not a member of this board", newOwnerUsername), http.StatusNotFound)
+		return
+	}
+	if newOwner.ID == user.ID {
+		http.Error(c.Writer, "You already own this board", http.StatusBadRequest)
 		return
 	}
-	err = templates.ExecuteTemplate(c.Writer, "newBoard.html", nil)
 
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&newOwnerMember).Update("role", RoleOwner).Error; err != nil {
+			return err
+		}
+		return tx.Model(&BoardMember{}).Where("board_id = ? AND user_id = ?", board.ID, user.ID).Update("role", RoleEditor).Error
+	})
 	if err != nil {
-		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		log.Printf("Could not transfer board %d to user %d: %v", board.ID, newOwner.ID, err)
+		http.Error(c.Writer, "Could not transfer ownership", http.StatusInternalServerError)
+		return
 	}
+	env.membershipChanged(board.ID, user.ID)
+	env.membershipChanged(board.ID, newOwner.ID)
+	log.Printf("User %d transferred board %d to user %d", user.ID, board.ID, newOwner.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
 }
 
-func (env *Env) GetBoard(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
-	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+// LeaveBoard removes the signed in user from the board. The only owner has
+// to transfer ownership first so the board isn't left without one.
+func (env *Env) LeaveBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	if currentBoardRole(c) == RoleOwner && env.countBoardOwners(board.ID) <= 1 {
+		http.Error(c.Writer, "Transfer ownership to another member before leaving", http.StatusConflict)
 		return
 	}
-	user, err := env.getUserFromSession(sessionId)
-	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+
+	result := env.db.Unscoped().Where("board_id = ? AND user_id = ?", board.ID, user.ID).Delete(&BoardMember{})
+	if result.Error != nil {
+		log.Printf("Could not remove user %d from board %d: %v", user.ID, board.ID, result.Error)
+		http.Error(c.Writer, "Could not leave board", http.StatusInternalServerError)
 		return
 	}
+	if result.RowsAffected == 0 {
+		// Their access comes from a team grant, which leaving can't remove
+		http.Error(c.Writer, "You have access to this board through a team. Leave the team or ask the board's owner to remove the team", http.StatusConflict)
+		return
+	}
+	env.membershipChanged(board.ID, user.ID)
+	log.Printf("User %d left board %d", user.ID, board.ID)
+	c.Redirect(http.StatusFound, "/boards")
+}
 
-	boardId := c.Params.ByName("boardId")
-	boardMember := BoardMember{}
-// TODO: Check if there's a result from this if the query fails
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, user.ID)
+// DuplicateBoard copies the board and all of its lines to a new board owned by
+// the signed in user. Owners can also copy the members and team grants.
+func (env *Env) DuplicateBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	copyMembers := c.PostForm("copyMembers") == "on"
+	if copyMembers && currentBoardRole(c) != RoleOwner {
+		http.Error(c.Writer, "Only owners can copy a board's members", http.StatusForbidden)
+		return
+	}
 
-	if boardMember.BoardID == 0 {
-		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
+	boardName := "Copy of " + board.BoardName
+	if utf8.RuneCountInString(boardName) > maxBoardNameLength {
+		boardName = string([]rune(boardName)[:maxBoardNameLength])
+	}
+	if name := c.PostForm("boardName"); name != "" {
+		var err error
+		boardName, err = validateBoardName(name)
+		if err != nil {
+			http.Error(c.Writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
+	newBoard := Board{
+		BoardName:        boardName,
+		Description:      board.Description,
+		BackgroundColour: board.BackgroundColour,
+		GridStyle:        board.GridStyle,
+		StrokeColour:     board.StrokeColour,
+		StrokeWidth:      board.StrokeWidth,
+	}
+	var copiedLines int64
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newBoard).Error; err != nil {
+			return err
+		}
+		var err error
+		copiedLines, err = copyBoardLines(tx, board.ID, newBoard.ID)
 		if err != nil {
-			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+
+		if copyMembers {
+			err = tx.Exec(`INSERT INTO board_members (board_id, user_id, role, created_at, updated_at)
+				SELECT ?, user_id, role, now(), now() FROM board_members WHERE board_id = ? AND user_id <> ? AND deleted_at IS NULL`, newBoard.ID, board.ID, user.ID).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Exec(`INSERT INTO board_team_grants (board_id, team_id, role, created_at, updated_at)
+				SELECT ?, team_id, role, now(), now() FROM board_team_grants WHERE board_id = ? AND deleted_at IS NULL`, newBoard.ID, board.ID).Error
+			if err != nil {
+				return err
+			}
 		}
+		return tx.Create(&BoardMember{BoardID: newBoard.ID, UserID: user.ID, Role: RoleOwner}).Error
+	})
+	if err != nil {
+		log.Printf("Could not duplicate board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not duplicate board", http.StatusInternalServerError)
 		return
 	}
 
+	log.Printf("User %d duplicated board %d as board %d with %d lines", user.ID, board.ID, newBoard.ID, copiedLines)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", newBoard.ID))
+}
+
+// copyBoardLines copies every line on one board to another with new ids,
+// returning how many were copied. The copy happens inside the database so big
+// boards aren't loaded into memory.
+func copyBoardLines(tx *gorm.DB, fromBoardId uint, toBoardId uint) (int64, error) {
+	result := tx.Exec(`INSERT INTO lines (id, created_at, updated_at, points, board_id)
+		SELECT uuid_generate_v4(), now(), now(), points, ? FROM lines WHERE board_id = ? AND deleted_at IS NULL`, toBoardId, fromBoardId)
+	return result.RowsAffected, result.Error
+}
 
-	log.Printf("BoardId: %s", boardId)
+// membershipChanged must be called whenever someone's access to a board may
+// have changed, directly or through a team. It drops the cached role and
+// passes the new one on to their live connections.
+func (env *Env) membershipChanged(boardId uint, userId uint) {
+	env.memberships.invalidate(boardId, userId)
+	user := User{}
+	user.ID = userId
 	board := Board{}
-	db.First(&board, boardId)
-	log.Printf("Boardname %s id %d\n", board.BoardName, board.ID)
-	log.Printf("=========================")
+	board.ID = boardId
+	env.db.Select("id", "is_template").First(&board)
+	role, _ := env.boardRoleForUser(user, board)
+	env.hubs.notifyMembershipChange(int(boardId), userId, templateRole(board, role))
+}
 
-	err = templates.ExecuteTemplate(c.Writer, "boardDetails.html", board)
+// boardMemberRow is a member as listed on the members page.
+type boardMemberRow struct {
+	ID       uint
+	Username string
+	Role     string
+}
+
+func (env *Env) GetBoardMembers(c *gin.Context) {
+	board := currentBoard(c)
+	members := []boardMemberRow{}
+	env.db.Table("users").Select("users.username, users.id, board_members.role").Joins("JOIN board_members on users.id = board_members.user_id").Where("board_members.board_id = ?", board.ID).Find(&members)
+	isOwner := currentBoardRole(c) == RoleOwner
+	templateVars := map[string]interface{}{"board_id": board.ID, "members": members, "isOwner": isOwner, "roles": roles}
+	if isOwner {
+		templateVars["invitations"] = env.invitationsForBoard(board)
+	}
+	err := templates.ExecuteTemplate(c.Writer, "boardMembers.html", templateVars)
 
 	if err != nil {
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func (env *Env) GetBoardMembers(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
-	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
-		return
+func (env *Env) isUserMemberOfBoard(user User, board Board) bool {
+	_, isMember := env.boardRoleForUser(user, board)
+	return isMember
+}
+
+// boardRoleForUser works out the user's role from their BoardMember row and
+// any grants to teams they're in, going through env.memberships first.
+// Anything that changes membership must invalidate the cache.
+func (env *Env) boardRoleForUser(user User, board Board) (string, bool) {
+	if role, ok := env.memberships.get(board.ID, user.ID); ok {
+		return role, role != ""
+	}
+
+	grantedRoles := []string{}
+	err := env.db.Model(&BoardMember{}).Where("board_id = ? AND user_id = ?", board.ID, user.ID).Pluck("role", &grantedRoles).Error
+	if err == nil {
+		teamRoles := []string{}
+		err = env.db.Model(&BoardTeamGrant{}).
+			Joins("JOIN team_members ON team_members.team_id = board_team_grants.team_id").
+			Where("board_team_grants.board_id = ? AND team_members.user_id = ?", board.ID, user.ID).
+			Pluck("board_team_grants.role", &teamRoles).Error
+		grantedRoles = append(grantedRoles, teamRoles...)
 	}
-	user, err := env.getUserFromSession(sessionId)
 	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
-		return
+		// Don't cache this, the next request might succeed
+		log.Printf("Could not check membership of user %d for board %d: %v", user.ID, board.ID, err)
+		return "", false
 	}
-	// TODO: Handle this error and make convienence function for getting board id from params
-	boardId, _ := strconv.Atoi(c.Params.ByName("boardId"))
-	board := Board{}
-	board.ID = uint(boardId)
-	userIsMemberOfBoard := env.isUserMemberOfBoard(user, board)
 
-	if !userIsMemberOfBoard {
-		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
+	role := highestRole(grantedRoles)
+	env.memberships.set(board.ID, user.ID, role)
+	return role, role != ""
+}
 
-		if err != nil {
-			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
-		}
-		return
+// authorizeBoard loads the board with the given id and returns the user's
+// role on it. On failure it returns the http status to respond with.
+func (env *Env) authorizeBoard(user User, rawBoardId string) (Board, string, int, error) {
+	boardId, err := strconv.Atoi(rawBoardId)
+	if err != nil {
+		return Board{}, "", http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid board id %s", rawBoardId))
 	}
-	users := []User{}
-	env.db.Table("users").Select("username, id").Joins("JOIN board_members on users.id = board_members.user_id").Where("board_members.board_id = ?", board.ID).Find(&users)
-	templateVars := map[string]interface{}{"board_id": board.ID, "users": users}
-	err = templates.ExecuteTemplate(c.Writer, "boardMembers.html", templateVars)
 
+	board := Board{}
+	err = env.db.First(&board, boardId).Error
 	if err != nil {
-		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Board{}, "", http.StatusNotFound, errors.New(fmt.Sprintf("Board %d not found", boardId))
+		}
+		return Board{}, "", http.StatusInternalServerError, errors.Wrap(err, "could not load board")
 	}
-}
 
-func (env *Env) isUserMemberOfBoard(user User, board Board) bool {
-	boardMember := BoardMember{}
+	role, isMember := env.boardRoleForUser(user, board)
+	if !isMember {
+		return board, "", http.StatusForbidden, errors.New(fmt.Sprintf("User %d has no membership for board %d", user.ID, board.ID))
+	}
+	return board, templateRole(board, role), http.StatusOK, nil
+}
 
-	if result := env.db.First(&boardMember, "board_id = ? AND user_id = ?", board.ID, user.ID); result.Error != nil {
-		return false
+// boardErrorMessage is what pages show when authorizeBoard fails with status.
+func boardErrorMessage(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "Invalid board"
+	case http.StatusNotFound:
+		return "This board doesn't exist"
+	case http.StatusForbidden:
+		return "You don't have permission for this board"
+	default:
+		return "Could not load this board"
 	}
-	return true
 }
 
+// GetBoardsForUser lists the user's boards a page at a time, as HTML or JSON.
+// See parseBoardListQuery for the search, sort, paging and filter parameters.
 func (env *Env) GetBoardsForUser(c *gin.Context) {
-	sessionId, err := getSessionIdFromCookie(c)
+	user := currentUser(c)
+
+	query, err := env.parseBoardListQuery(c, user)
 	if err != nil {
-		panic(err)
+		abortWithError(c, http.StatusBadRequest, err)
+		return
 	}
-	user, err := env.getUserFromSession(sessionId)
+	boards, nextCursor, err := env.listBoards(user, query)
 	if err != nil {
-		c.Redirect(http.StatusFound, "/signin")
+		log.Printf("Could not list boards for user %d: %v", user.ID, err)
+		abortWithError(c, http.StatusInternalServerError, errors.New("Could not list boards"))
 		return
 	}
 
-	var results []map[string]interface{}
+	// Favourites and recent boards are only shown above the first page of the
+	// whole list
+	var favourites, recent []boardListRow
+	if query.after == nil && !query.filtered() {
+		favourites, err = env.favouriteBoards(user)
+		if err == nil {
+			recent, err = env.recentBoards(user)
+		}
+		if err != nil {
+			log.Printf("Could not list favourite and recent boards for user %d: %v", user.ID, err)
+			abortWithError(c, http.StatusInternalServerError, errors.New("Could not list boards"))
+			return
+		}
+	}
 
-	env.db.Table("board_members").Select("boards.ID", "boards.board_name").Joins("JOIN boards on boards.id = board_members.board_id").Where("board_members.user_id = ?", user.ID).Find(&results)
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, gin.H{"boards": boards, "nextCursor": nextCursor, "favourites": favourites, "recent": recent})
+		return
+	}
 
-	err = templates.ExecuteTemplate(c.Writer, "boards.html", results)
+	templateVars := map[string]interface{}{
+		"boards":     boards,
+		"favourites": favourites,
+		"recent":     recent,
+		"q":          query.search,
+		"sort":       query.sort,
+		"sorts":      boardListSorts,
+		"folders":    env.foldersForUser(user),
+		"teams":      env.teamsForUser(user),
+		"tags":       env.tagsForUser(user),
+		"tag":        query.tag,
+	}
+	if query.folder != nil {
+		templateVars["folder"] = *query.folder
+		templateVars["canDeleteFolder"] = env.canManageFolder(user, *query.folder)
+	}
+	if nextCursor != "" {
+		templateVars["nextPage"] = query.nextPageURL(nextCursor)
+	}
+	err = templates.ExecuteTemplate(c.Writer, "boards.html", templateVars)
 
 	if err != nil {
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// accessibleBoardIds is a subquery for the ids of boards the user is a member
+// of, directly or through a team.
+func (env *Env) accessibleBoardIds(user User) *gorm.DB {
+	direct := env.db.Model(&BoardMember{}).Select("board_id").Where("user_id = ?", user.ID)
+	viaTeams := env.db.Model(&BoardTeamGrant{}).Select("board_team_grants.board_id").
+		Joins("JOIN team_members ON team_members.team_id = board_team_grants.team_id").
+		Where("team_members.user_id = ?", user.ID)
+	return env.db.Raw("? UNION ?", direct, viaTeams)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultBoardListLimit = 20
+	maxBoardListLimit     = 100
+	recentBoardsLimit     = 5
+)
+
+// Ways the board list can be sorted. Names sort A-Z, the others newest first.
+const (
+	sortByName     = "name"
+	sortByCreated  = "created"
+	sortByActivity = "activity"
+)
+
+var boardListSorts = []string{sortByActivity, sortByName, sortByCreated}
+
+// boardListRow is a board as listed on /boards.
+type boardListRow struct {
+	ID           uint      `json:"id"`
+	BoardName    string    `json:"boardName"`
+	CreatedAt    time.Time `json:"createdAt"`
+	MemberCount  int64     `json:"memberCount"`
+	LastModified time.Time `json:"lastModified"`
+	Favourite    bool      `json:"favourite"`
+}
+
+// boardListQuery is what the user asked /boards for.
+type boardListQuery struct {
+	search string
+	sort   string
+	limit  int
+	after  *boardListCursor
+	// Only list boards in this folder, which the user must be able to see
+	folder *Folder
+	// Only list boards with this tag
+	tag string
+}
+
+// filtered reports whether the list is narrowed down by a search or filter.
+func (query boardListQuery) filtered() bool {
+	return query.search != "" || query.folder != nil || query.tag != ""
+}
+
+// boardListCursor is the sort value and id of the last board on the previous
+// page. It's handed to clients as an opaque string.
+type boardListCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func (cursor boardListCursor) encode() string {
+	encoded, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeBoardListCursor(raw string) (*boardListCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	cursor := boardListCursor{}
+	err = json.Unmarshal(decoded, &cursor)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// parseBoardListQuery reads the q, sort, limit, cursor, folder and tag query
+// parameters.
+func (env *Env) parseBoardListQuery(c *gin.Context, user User) (boardListQuery, error) {
+	query := boardListQuery{
+		search: strings.TrimSpace(c.Query("q")),
+		sort:   c.DefaultQuery("sort", sortByActivity),
+		limit:  defaultBoardListLimit,
+		tag:    normalizeTag(c.Query("tag")),
+	}
+
+	validSort := false
+	for _, sort := range boardListSorts {
+		if sort == query.sort {
+			validSort = true
+		}
+	}
+	if !validSort {
+		return query, errors.New(fmt.Sprintf("Sort must be one of %s", strings.Join(boardListSorts, ", ")))
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsedLimit, err := strconv.Atoi(limit)
+		if err != nil || parsedLimit < 1 || parsedLimit > maxBoardListLimit {
+			return query, errors.New(fmt.Sprintf("Limit must be between 1 and %d", maxBoardListLimit))
+		}
+		query.limit = parsedLimit
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, err := decodeBoardListCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.after = after
+	}
+
+	if folderId := c.Query("folder"); folderId != "" {
+		folder, err := env.visibleFolder(user, folderId)
+		if err != nil {
+			return query, errors.New("Folder not found")
+		}
+		query.folder = &folder
+	}
+	return query, nil
+}
+
+// escapeLike escapes the wildcards in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// boardListRows selects boardListRows for the boards the user can open.
+func (env *Env) boardListRows(user User) *gorm.DB {
+	return env.db.Model(&Board{}).
+		Select(`boards.id, boards.board_name, boards.created_at,
+			(SELECT count(*) FROM board_members WHERE board_members.board_id = boards.id AND board_members.deleted_at IS NULL) AS member_count,
+			COALESCE((SELECT max(lines.updated_at) FROM lines WHERE lines.board_id = boards.id AND lines.deleted_at IS NULL), boards.created_at) AS last_modified,
+			EXISTS (SELECT 1 FROM favourite_boards WHERE favourite_boards.board_id = boards.id AND favourite_boards.user_id = ?) AS favourite`, user.ID).
+		Where("boards.id IN (?)", env.accessibleBoardIds(user))
+}
+
+// favouriteBoards returns every board the user starred, A-Z.
+func (env *Env) favouriteBoards(user User) ([]boardListRow, error) {
+	rows := []boardListRow{}
+	err := env.boardListRows(user).
+		Joins("JOIN favourite_boards ON favourite_boards.board_id = boards.id AND favourite_boards.user_id = ?", user.ID).
+		Order("boards.board_name").
+		Scan(&rows).Error
+	return rows, err
+}
+
+// recentBoards returns the boards the user opened most recently.
+func (env *Env) recentBoards(user User) ([]boardListRow, error) {
+	rows := []boardListRow{}
+	err := env.boardListRows(user).
+		Joins("JOIN board_visits ON board_visits.board_id = boards.id AND board_visits.user_id = ?", user.ID).
+		Order("board_visits.last_opened_at DESC").
+		Limit(recentBoardsLimit).
+		Scan(&rows).Error
+	return rows, err
+}
+
+// listBoards returns a page of the user's boards and the cursor for the next
+// page, which is empty on the last page.
+func (env *Env) listBoards(user User, query boardListQuery) ([]boardListRow, string, error) {
+	boards := env.boardListRows(user)
+	if query.search != "" {
+		boards = boards.Where("boards.board_name ILIKE ?", "%"+escapeLike(query.search)+"%")
+	}
+	if query.folder != nil {
+		boards = boards.Where("boards.id IN (?)", env.db.Model(&BoardFolder{}).Select("board_id").Where("folder_id = ?", query.folder.ID))
+	}
+	if query.tag != "" {
+		boards = boards.Where("boards.id IN (?)", env.db.Model(&BoardTag{}).Select("board_id").Where("tag = ?", query.tag))
+	}
+
+	// Wrapping the query lets the cursor compare against last_modified
+	list := env.db.Table("(?) AS board_list", boards)
+	switch query.sort {
+	case sortByName:
+		list = list.Order("board_name, id")
+	case sortByCreated:
+		list = list.Order("created_at DESC, id DESC")
+	default:
+		list = list.Order("last_modified DESC, id DESC")
+	}
+
+	if query.after != nil {
+		if query.sort == sortByName {
+			list = list.Where("(board_name, id) > (?, ?)", query.after.Value, query.after.ID)
+		} else {
+			after, err := time.Parse(time.RFC3339Nano, query.after.Value)
+			if err != nil {
+				return nil, "", errors.New("Invalid cursor")
+			}
+			column := "last_modified"
+			if query.sort == sortByCreated {
+				column = "created_at"
+			}
+			list = list.Where(fmt.Sprintf("(%s, id) < (?, ?)", column), after, query.after.ID)
+		}
+	}
+
+	rows := []boardListRow{}
+	// Fetch one extra row to find out if there's another page
+	err := list.Limit(query.limit + 1).Scan(&rows).Error
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rows) <= query.limit {
+		return rows, "", nil
+	}
+
+	rows = rows[:query.limit]
+	last := rows[len(rows)-1]
+	next := boardListCursor{ID: last.ID}
+	switch query.sort {
+	case sortByName:
+		next.Value = last.BoardName
+	case sortByCreated:
+		next.Value = last.CreatedAt.Format(time.RFC3339Nano)
+	default:
+		next.Value = last.LastModified.Format(time.RFC3339Nano)
+	}
+	return rows, next.encode(), nil
+}
+
+// nextPageURL links to the page after cursor, keeping the search and sort.
+func (query boardListQuery) nextPageURL(cursor string) string {
+	params := url.Values{}
+	if query.search != "" {
+		params.Set("q", query.search)
+	}
+	if query.folder != nil {
+		params.Set("folder", strconv.Itoa(int(query.folder.ID)))
+	}
+	if query.tag != "" {
+		params.Set("tag", query.tag)
+	}
+	params.Set("sort", query.sort)
+	params.Set("limit", strconv.Itoa(query.limit))
+	params.Set("cursor", cursor)
+	return "/boards?" + params.Encode()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxBoardNameLength        = 100
+	maxBoardDescriptionLength = 1000
+	maxStrokeWidth            = 50
+)
+
+var (
+	gridStyles  = []string{"none", "dots", "lines"}
+	colourRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// BoardSettings is how a board's settings are sent to API clients and to the
+// canvas.
+type BoardSettings struct {
+	BoardName        string `json:"boardName"`
+	Description      string `json:"description"`
+	BackgroundColour string `json:"backgroundColour"`
+	GridStyle        string `json:"gridStyle"`
+	StrokeColour     string `json:"strokeColour"`
+	StrokeWidth      int    `json:"strokeWidth"`
+}
+
+func (b Board) settings() BoardSettings {
+	return BoardSettings{
+		BoardName:        b.BoardName,
+		Description:      b.Description,
+		BackgroundColour: b.BackgroundColour,
+		GridStyle:        b.GridStyle,
+		StrokeColour:     b.StrokeColour,
+		StrokeWidth:      b.StrokeWidth,
+	}
+}
+
+// boardSettingsUpdate is the body of a settings change. Fields left out keep
+// their current value.
+type boardSettingsUpdate struct {
+	BoardName        *string `form:"boardName" json:"boardName"`
+	Description      *string `form:"description" json:"description"`
+	BackgroundColour *string `form:"backgroundColour" json:"backgroundColour"`
+	GridStyle        *string `form:"gridStyle" json:"gridStyle"`
+	StrokeColour     *string `form:"strokeColour" json:"strokeColour"`
+	StrokeWidth      *int    `form:"strokeWidth" json:"strokeWidth"`
+}
+
+// validateBoardName trims name and checks it's a usable board name.
+func validateBoardName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxBoardNameLength {
+		return "", errors.New(fmt.Sprintf("Board name must be between 1 and %d characters", maxBoardNameLength))
+	}
+	return name, nil
+}
+
+func isValidGridStyle(gridStyle string) bool {
+	for _, g := range gridStyles {
+		if g == gridStyle {
+			return true
+		}
+	}
+	return false
+}
+
+// changes validates the update and returns the columns it changes.
+func (u boardSettingsUpdate) changes() (map[string]interface{}, error) {
+	changes := map[string]interface{}{}
+	if u.BoardName != nil {
+		name, err := validateBoardName(*u.BoardName)
+		if err != nil {
+			return nil, err
+		}
+		changes["board_name"] = name
+	}
+	if u.Description != nil {
+		description := strings.TrimSpace(*u.Description)
+		if utf8.RuneCountInString(description) > maxBoardDescriptionLength {
+			return nil, errors.New(fmt.Sprintf("Description must be at most %d characters", maxBoardDescriptionLength))
+		}
+		changes["description"] = description
+	}
+	if u.BackgroundColour != nil {
+		if !colourRegex.MatchString(*u.BackgroundColour) {
+			return nil, errors.New("Background colour must look like #rrggbb")
+		}
+		changes["background_colour"] = strings.ToLower(*u.BackgroundColour)
+	}
+	if u.GridStyle != nil {
+		if !isValidGridStyle(*u.GridStyle) {
+			return nil, errors.New(fmt.Sprintf("Grid style must be one of %s", strings.Join(gridStyles, ", ")))
+		}
+		changes["grid_style"] = *u.GridStyle
+	}
+	if u.StrokeColour != nil {
+		if !colourRegex.MatchString(*u.StrokeColour) {
+			return nil, errors.New("Stroke colour must look like #rrggbb")
+		}
+		changes["stroke_colour"] = strings.ToLower(*u.StrokeColour)
+	}
+	if u.StrokeWidth != nil {
+		if *u.StrokeWidth < 1 || *u.StrokeWidth > maxStrokeWidth {
+			return nil, errors.New(fmt.Sprintf("Stroke width must be between 1 and %d", maxStrokeWidth))
+		}
+		changes["stroke_width"] = *u.StrokeWidth
+	}
+	return changes, nil
+}
+
+// UpdateBoardSettings changes the board's settings and pushes them to
+// everyone who has the board open. It takes JSON or a form.
+func (env *Env) UpdateBoardSettings(c *gin.Context) {
+	board := currentBoard(c)
+
+	update := boardSettingsUpdate{}
+	err := c.ShouldBind(&update)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, "invalid board settings"))
+		return
+	}
+	changes, err := update.changes()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(changes) > 0 {
+		err = env.db.Model(&board).Updates(changes).Error
+		if err != nil {
+			log.Printf("Could not update settings of board %d: %v", board.ID, err)
+			abortWithError(c, http.StatusInternalServerError, errors.New("Could not update board settings"))
+			return
+		}
+		env.boardSettingsChanged(board)
+		log.Printf("Updated settings of board %d", board.ID)
+	}
+
+	if wantsJSON(c) {
+		c.JSON(http.StatusOK, board.settings())
+		return
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+// boardSettingsChanged sends the board's new settings to its open canvases.
+func (env *Env) boardSettingsChanged(board Board) {
+	message, err := newEnvelope(messageSettings, 0, board.settings())
+	if err != nil {
+		log.Printf("Error marshalling board settings: %v", err)
+		return
+	}
+	env.hubs.broadcast(int(board.ID), message)
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -28,8 +31,11 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer, unless MAX_MESSAGE_SIZE is set.
+	defaultMaxMessageSize = 16 * 1024
+
+	// MAX_MESSAGE_SIZE can't be set lower than this.
+	minMaxMessageSize = 512
 )
 
 var (
@@ -37,18 +43,77 @@ var (
 	space   = []byte{' '}
 )
 
-type DrawnPointMessage struct {
-	Id    uuid.UUID
-	Point Point
+// maxMessageSizeFromEnv reads the largest message clients can send from
+// MAX_MESSAGE_SIZE.
+func maxMessageSizeFromEnv() int64 {
+	size := os.Getenv("MAX_MESSAGE_SIZE")
+	if size == "" {
+		return defaultMaxMessageSize
+	}
+	parsedSize, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || parsedSize < minMaxMessageSize {
+		log.Printf("Invalid MAX_MESSAGE_SIZE %s, using the default", size)
+		return defaultMaxMessageSize
+	}
+	return parsedSize
 }
 
-var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+var errBoardGone = errors.New("board has been deleted")
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024, Subprotocols: []string{protocolName}}
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+
+	// Acks, nacks and errors about this client's own messages. Unlike send the
+	// hub never closes it. Replies are sent in the order the messages came in.
+	replies chan []byte
+
+	// Closed when writePump stops, so nothing waits on replies forever.
+	writerDone chan struct{}
+
+	// The seq of the last message from the client. Seqs have to increase.
+	lastSeq uint64
+
+	// The last board revision the client saw before reconnecting, 0 if it
+	// needs the whole board.
+	since int64
+
+	// The protocol version negotiated when connecting.
+	protocolVersion int
+
+	// Messages bigger than this close the connection.
+	maxMessageSize int64
+
+	// 0 for anonymous viewers using a share link.
+	userId   uint
+	username string
+
+	// The user's role on the board. Viewers are sent the board but can't draw.
+	// The hub changes it when the user's membership changes, so go through
+	// getRole and setRole.
+	roleMu sync.Mutex
+	role   string
+
+	// Set by the hub before it closes send to say why the client was
+	// disconnected.
+	closeCode   int
+	closeReason string
+}
+
+func (c *Client) getRole() string {
+	c.roleMu.Lock()
+	defer c.roleMu.Unlock()
+	return c.role
+}
+
+func (c *Client) setRole(role string) {
+	c.roleMu.Lock()
+	defer c.roleMu.Unlock()
+	c.role = role
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -58,11 +123,14 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(c.maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -71,37 +139,197 @@ func (c *Client) readPump() {
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
-			//if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-			//	log.Printf("error: %v", err)
-			//}
-			// TODO: Check if it was message too big/read limit exceeded
+			// Messages over maxMessageSize are closed with 1009 by the websocket library
 			log.Printf("error: %v", err)
-			c.conn.WriteMessage(websocket.TextMessage, []byte("CLOSING SINCE MESSAGE TOO BIG"))
 			break
 		}
-		// TODO: @FIX The message sent by the client will also be replayed back to themselves, stop this (could this be used as a "received message" on client side to show success?, or alert user to dropped connectivity?)
 		message = bytes.TrimSpace(bytes.Replace(message, newLine, space, -1))
-//		log.Printf("Message: %s", message)
-//		log.Printf("Message length %d", len(message))
-		var drawnPointMessage DrawnPointMessage
-		err = json.Unmarshal(message, &drawnPointMessage)
+		var envelope Envelope
+		err = json.Unmarshal(message, &envelope)
 		if err != nil {
 			log.Printf("Error unmarshalling message %s: %v", message, err)
-			// TODO: Should return something here?
-			c.conn.WriteMessage(websocket.TextMessage, []byte("Invalid UUID"))
+			c.reply(errorEnvelope(errorInvalidMessage, "Messages must be JSON envelopes"))
+			continue
+		}
+		if envelope.Seq <= c.lastSeq {
+			c.reply(errorEnvelope(errorInvalidSeq, fmt.Sprintf("Message seq must be more than %d", c.lastSeq)))
+			continue
+		}
+		c.lastSeq = envelope.Seq
+		if envelope.Version != c.protocolVersion {
+			c.reply(nackEnvelope(envelope.Seq, errorUnsupportedVersion, fmt.Sprintf("This connection uses version %d", c.protocolVersion)))
+			continue
+		}
+
+		switch envelope.Type {
+		case messageStrokeStart, messagePoint:
+			err = c.handlePoint(envelope)
+		case messageSegment:
+			err = c.handleSegment(envelope)
+		case messageStrokeEnd:
+			err = c.handleStrokeEnd(envelope)
+		default:
+			c.reply(nackEnvelope(envelope.Seq, errorUnknownType, fmt.Sprintf("Unknown message type %q", envelope.Type)))
 			continue
 		}
-		c.hub.broadcast <- message
+		if err != nil {
+			// The hub or writePump has stopped
+			return
+		}
+	}
+}
+
+// reply queues a message for this client alone. It only fails once
+// writePump has stopped.
+func (c *Client) reply(message []byte) error {
+	select {
+	case c.replies <- message:
+		return nil
+	case <-c.writerDone:
+		return errors.New("connection closed")
+	}
+}
+
+// canDraw checks the client is allowed to draw, nacking the message if it
+// isn't.
+func (c *Client) canDraw(envelope Envelope) bool {
+	if !roleCanDraw(c.getRole()) {
+		c.reply(nackEnvelope(envelope.Seq, errorForbidden, "Viewers can't draw on this board"))
+		return false
+	}
+	return true
+}
+
+// relay passes message on to everyone else on the board, then acks it. It
+// only returns an error if the client or the hub has stopped.
+func (c *Client) relay(envelope Envelope, payload interface{}) error {
+	reply, err := c.passOn(envelope, payload)
+	if err != nil {
+		return err
+	}
+	return c.reply(reply)
+}
+
+// passOn hands message to the hub for everyone else on the board. It returns
+// the ack to send, or a nack if the message couldn't be encoded, without
+// waiting for the client to take it. It only returns an error if the hub has
+// stopped.
+func (c *Client) passOn(envelope Envelope, payload interface{}) ([]byte, error) {
+	message, err := newEnvelope(envelope.Type, 0, payload)
+	if err != nil {
+		log.Printf("Error marshalling %s: %v", envelope.Type, err)
+		return nackEnvelope(envelope.Seq, errorInvalidMessage, "Could not encode message"), nil
+	}
+	select {
+	case c.hub.broadcast <- broadcastMessage{sender: c, data: message}:
+	case <-c.hub.done:
+		return nil, errors.New("hub stopped")
+	}
+	return ackEnvelope(envelope.Seq), nil
+}
 
-		pointsFormatted := fmt.Sprintf(`{"points": [{"X": %f, "Y": %f}]}`, drawnPointMessage.Point.X, drawnPointMessage.Point.Y)
-		line := Line{Id: drawnPointMessage.Id, Points: datatypes.JSON(pointsFormatted), BoardId: c.hub.boardId}
-		// TODO: Update updated time to time now
-		db.Clauses(clause.OnConflict{
+// savePoints appends points to the stroke in one upsert, creating the line if
+// it's new, and returns the board revision they were saved as.
+func savePoints(boardId int, id uuid.UUID, points []Point) (int64, error) {
+	formattedPoints := make([]string, len(points))
+	for i, point := range points {
+		formattedPoints[i] = fmt.Sprintf(`{"X": %f, "Y": %f}`, point.X, point.Y)
+	}
+	pointsArray := "[" + strings.Join(formattedPoints, ", ") + "]"
+
+	var revision int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Locks the board's row, so a point is either saved before the board is
+		// deleted and goes in the trash with it, or isn't saved at all
+		result := tx.Raw("UPDATE boards SET revision = revision + 1 WHERE id = ? AND deleted_at IS NULL RETURNING revision", boardId).Scan(&revision)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errBoardGone
+		}
+
+		pointsFormatted := fmt.Sprintf(`{"points": %s}`, pointsArray)
+		line := Line{Id: id, Points: datatypes.JSON(pointsFormatted), BoardId: boardId, Revision: revision}
+		return tx.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "id"}},
-			DoUpdates: clause.Assignments(map[string]interface{}{"points": gorm.Expr(`jsonb_set(lines.points::jsonb, array['points'], (lines.points->'points')::jsonb || ?::jsonb)`, fmt.Sprintf(`[{"X": %f, "Y": %f}]`, drawnPointMessage.Point.X, drawnPointMessage.Point.Y))}),
-		}).Create(&line)
-		//Before gorm on conflict: db.Exec(`INSERT INTO lines(id, points) VALUES(?, ?) ON CONFLICT (id) DO UPDATE SET points = jsonb_set(lines.points::jsonb, array['points'], (lines.points->'points')::jsonb || ?::jsonb)`, drawnPointMessage.Id, fmt.Sprintf(`{ "points": [{"X": %f, "Y": %f}] }`, drawnPointMessage.Point.X, drawnPointMessage.Point.Y), fmt.Sprintf(`[{"X": %f, "Y": %f}]`, drawnPointMessage.Point.X, drawnPointMessage.Point.Y))
+			DoUpdates: clause.Assignments(map[string]interface{}{"updated_at": time.Now(), "revision": revision, "points": gorm.Expr(`jsonb_set(lines.points::jsonb, array['points'], (lines.points->'points')::jsonb || ?::jsonb)`, pointsArray)}),
+		}).Create(&line).Error
+	})
+	return revision, err
+}
+
+// handlePoint stores a stroke-start or point message, then passes it on to
+// everyone on the board. Points that couldn't be saved are nacked and not
+// passed on.
+func (c *Client) handlePoint(envelope Envelope) error {
+	var payload strokePayload
+	err := json.Unmarshal(envelope.Payload, &payload)
+	if err != nil || payload.Id == uuid.Nil {
+		return c.reply(nackEnvelope(envelope.Seq, errorInvalidMessage, "Points need a stroke id and a point"))
+	}
+	if !c.canDraw(envelope) {
+		return nil
+	}
+
+	c.hub.writeMu.Lock()
+	payload.Revision, err = savePoints(c.hub.boardId, payload.Id, []Point{payload.Point})
+	if err != nil {
+		c.hub.writeMu.Unlock()
+		log.Printf("Could not save point on board %d: %v", c.hub.boardId, err)
+		return c.reply(nackEnvelope(envelope.Seq, errorNotSaved, "Could not save this point"))
+	}
+	// Only hold the lock until the hub has the broadcast, so a client that's
+	// slow to take its acks doesn't hold up drawing for everyone else
+	reply, err := c.passOn(envelope, payload)
+	c.hub.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.reply(reply)
+}
+
+// handleSegment stores a batch of points on a stroke, then passes the whole
+// batch on to everyone on the board. Either all of the points are saved and
+// acked or none are.
+func (c *Client) handleSegment(envelope Envelope) error {
+	var payload segmentPayload
+	err := json.Unmarshal(envelope.Payload, &payload)
+	if err != nil || payload.Id == uuid.Nil || len(payload.Points) == 0 {
+		return c.reply(nackEnvelope(envelope.Seq, errorInvalidMessage, "Segments need a stroke id and at least one point"))
+	}
+	if !c.canDraw(envelope) {
+		return nil
+	}
+
+	c.hub.writeMu.Lock()
+	payload.Revision, err = savePoints(c.hub.boardId, payload.Id, payload.Points)
+	if err != nil {
+		c.hub.writeMu.Unlock()
+		log.Printf("Could not save segment on board %d: %v", c.hub.boardId, err)
+		return c.reply(nackEnvelope(envelope.Seq, errorNotSaved, "Could not save these points"))
 	}
+	// Released before acking, as in handlePoint
+	reply, err := c.passOn(envelope, payload)
+	c.hub.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.reply(reply)
+}
+
+// handleStrokeEnd tells everyone on the board a stroke is finished. Strokes
+// are stored point by point, so there's nothing to save.
+func (c *Client) handleStrokeEnd(envelope Envelope) error {
+	var payload strokeEndPayload
+	err := json.Unmarshal(envelope.Payload, &payload)
+	if err != nil || payload.Id == uuid.Nil {
+		return c.reply(nackEnvelope(envelope.Seq, errorInvalidMessage, "stroke-end needs a stroke id"))
+	}
+	if !c.canDraw(envelope) {
+		return nil
+	}
+	return c.relay(envelope, payload)
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -114,6 +342,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.writerDone)
 	}()
 
 	for {
@@ -122,25 +351,22 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// Hub closed the channel
+				if c.closeCode != 0 {
+					log.Printf("Hub closing connection: %s", c.closeReason)
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+					return
+				}
 				log.Printf("Error: hub closing channel")
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			writer, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.write(message); err != nil {
 				return
 			}
-			writer.Write(message)
-
-			// Add queued messages to current websocket message
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				writer.Write(newLine)
-				writer.Write(<-c.send)
-			}
-
-			if err := writer.Close(); err != nil {
+		case message := <-c.replies:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.write(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -152,62 +378,108 @@ func (c *Client) writePump() {
 	}
 }
 
-func (env *Env) serveWs(boardHubs []*Hub, c *gin.Context) ([]*Hub, error) {
-	boardId, err := strconv.Atoi(c.Request.URL.Query()["board"][0])
+// write sends message along with any others queued in send as one websocket
+// message.
+func (c *Client) write(message []byte) error {
+	writer, err := c.conn.NextWriter(websocket.TextMessage)
 	if err != nil {
-		http.Error(c.Writer, "Requires board id", http.StatusBadRequest)
+		return err
 	}
-	log.Printf("Board id: %v", boardId)
-	// TODO: Check if board even exists
+	writer.Write(message)
+
+	// Add queued messages to current websocket message
+	n := len(c.send)
+	for i := 0; i < n; i++ {
+		writer.Write(newLine)
+		writer.Write(<-c.send)
+	}
+
+	return writer.Close()
+}
+
+func (env *Env) serveWs(c *gin.Context) error {
 	var board Board
-	err = db.First(&board, boardId).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			// TODO: Better http error code?
-			http.Error(c.Writer, "Non existent board", http.StatusBadRequest)
-			return boardHubs, nil
+	var role string
+	var userId uint
+	var username string
+	if shareToken := c.Query("share"); shareToken != "" {
+		// Share links are read only, whoever is using them
+		err := env.db.First(&board, "share_token = ?", shareToken).Error
+		if err != nil {
+			log.Printf("Rejecting websocket for share token: %v", err)
+			http.Error(c.Writer, "Invalid share link", http.StatusNotFound)
+			return nil
 		}
-	}
+		role = RoleViewer
+	} else {
+		user, err := env.userFromRequest(c)
 
-	// TODO: SPEEDUP: This is quite slow now, too many db calls potentially?
-	sessionId, _ := getSessionIdFromCookie(c)
-	user, err := env.getUserFromSession(sessionId)
+		if err != nil {
+			return errors.New("No session for this user");
+		}
 
-	if err != nil {
-		return nil, errors.New("No session for this user");
+		var status int
+		board, role, status, err = env.authorizeBoard(user, c.Query("board"))
+		if err != nil {
+			log.Printf("Rejecting websocket: %v", err)
+			http.Error(c.Writer, boardErrorMessage(status), status)
+			return nil
+		}
+		userId = user.ID
+		username = user.Username
+		env.recordBoardVisit(user, board)
 	}
+	boardId := int(board.ID)
+	log.Printf("Board id: %v", boardId)
 
-	boardMember := BoardMember{}
-
-	// TODO: Check if there's a result from this if the query fails
-	env.db.First(&boardMember, "board_id = ? AND user_id = ?", boardId, user.ID)
+	var since int64
+	if rawSince := c.Query("since"); rawSince != "" {
+		var err error
+		since, err = strconv.ParseInt(rawSince, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(c.Writer, "Invalid revision", http.StatusBadRequest)
+			return nil
+		}
+	}
 
-	if boardMember.BoardID == 0 {
-		return nil, errors.New(fmt.Sprintf("User %d has no membership for board %d", user.ID, boardId));
+	version, ok := negotiateProtocol(c.Request)
+	if !ok {
+		http.Error(c.Writer, fmt.Sprintf("Unsupported protocol, this server speaks %s", protocolName), http.StatusBadRequest)
+		return nil
 	}
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("error: %v", err)
-		return boardHubs, nil
+		return nil
 	}
 
-	var boardHubToUse *Hub
-	// TODO: boardHubs could just be a map?
-	for _, boardHub := range boardHubs {
-		if boardHub.boardId == boardId {
-			boardHubToUse = boardHub
-		}
+	client := &Client{
+		hub:             env.hubs.getOrCreate(boardId),
+		conn:            conn,
+		send:            make(chan []byte, 256),
+		replies:         make(chan []byte, 16),
+		writerDone:      make(chan struct{}),
+		since:           since,
+		protocolVersion: version,
+		maxMessageSize:  env.maxMessageSize,
+		userId:          userId,
+		username:        username,
+		role:            role,
 	}
-	if boardHubToUse == nil {
-		boardHubToUse = newHub(boardId)
-		go boardHubToUse.run()
-		boardHubs = append(boardHubs, boardHubToUse)
+	// The hub sends the board's history as soon as the client registers, so
+	// something has to be reading it
+	go client.writePump()
+	select {
+	case client.hub.register <- client:
+	case <-client.hub.done:
+		// The board was closed while we were joining
+		client.closeCode = closeCodeBoardDeleted
+		client.closeReason = "Board was deleted"
+		close(client.send)
+		return nil
 	}
-	client := &Client{hub: boardHubToUse, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
 
-	go client.writePump()
 	go client.readPump()
-	return boardHubs, nil
+	return nil
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+)
+
+// recordBoardVisit remembers that the user just opened the board, for the
+// recent boards list. Failing to record it shouldn't stop them opening it.
+func (env *Env) recordBoardVisit(user User, board Board) {
+	visit := BoardVisit{BoardID: board.ID, UserID: user.ID, LastOpenedAt: time.Now()}
+	err := env.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "board_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_opened_at"}),
+	}).Create(&visit).Error
+	if err != nil {
+		log.Printf("Could not record visit to board %d by user %d: %v", board.ID, user.ID, err)
+	}
+}
+
+func (env *Env) FavouriteBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	favourite := FavouriteBoard{BoardID: board.ID, UserID: user.ID}
+	err := env.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&favourite).Error
+	if err != nil {
+		log.Printf("Could not favourite board %d for user %d: %v", board.ID, user.ID, err)
+		abortWithError(c, http.StatusInternalServerError, errors.New("Could not favourite board"))
+		return
+	}
+	respondToFavouriteChange(c)
+}
+
+func (env *Env) UnfavouriteBoard(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	err := env.db.Where("board_id = ? AND user_id = ?", board.ID, user.ID).Delete(&FavouriteBoard{}).Error
+	if err != nil {
+		log.Printf("Could not unfavourite board %d for user %d: %v", board.ID, user.ID, err)
+		abortWithError(c, http.StatusInternalServerError, errors.New("Could not unfavourite board"))
+		return
+	}
+	respondToFavouriteChange(c)
+}
+
+// respondToFavouriteChange sends browsers back to the board list after a star
+// was added or removed.
+func respondToFavouriteChange(c *gin.Context) {
+	if wantsJSON(c) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.Redirect(http.StatusFound, "/boards")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxFolderNameLength = 100
+
+// folderRow is a folder as listed on the boards and board details pages.
+type folderRow struct {
+	ID   uint
+	Name string
+	// Empty for the user's own folders
+	TeamName string
+}
+
+// visibleFolders finds the user's own folders and those of teams they're in.
+func (env *Env) visibleFolders(user User) *gorm.DB {
+	userTeamIds := env.db.Model(&TeamMember{}).Select("team_id").Where("user_id = ?", user.ID)
+	return env.db.Model(&Folder{}).Where("folders.owner_user_id = ? OR folders.owner_team_id IN (?)", user.ID, userTeamIds)
+}
+
+// visibleFolder loads the folder with the given id if the user can see it.
+func (env *Env) visibleFolder(user User, rawFolderId string) (Folder, error) {
+	folder := Folder{}
+	folderId, err := strconv.Atoi(rawFolderId)
+	if err != nil {
+		return folder, err
+	}
+	err = env.visibleFolders(user).First(&folder, folderId).Error
+	return folder, err
+}
+
+func (env *Env) foldersForUser(user User) []folderRow {
+	folders := []folderRow{}
+	env.visibleFolders(user).
+		Select("folders.id, folders.name, teams.name AS team_name").
+		Joins("LEFT JOIN teams ON teams.id = folders.owner_team_id").
+		Order("teams.name NULLS FIRST, folders.name").
+		Scan(&folders)
+	return folders
+}
+
+// boardFoldersForUser returns the folders the user can see that board is in.
+func (env *Env) boardFoldersForUser(user User, board Board) []folderRow {
+	folders := []folderRow{}
+	env.visibleFolders(user).
+		Select("folders.id, folders.name, teams.name AS team_name").
+		Joins("JOIN board_folders ON board_folders.folder_id = folders.id").
+		Joins("LEFT JOIN teams ON teams.id = folders.owner_team_id").
+		Where("board_folders.board_id = ?", board.ID).
+		Order("folders.name").
+		Scan(&folders)
+	return folders
+}
+
+// canManageFolder reports whether the user can delete the folder: it has to
+// be theirs, or they have to be an admin of the team that owns it.
+func (env *Env) canManageFolder(user User, folder Folder) bool {
+	if folder.OwnerUserID != nil {
+		return *folder.OwnerUserID == user.ID
+	}
+	var admins int64
+	env.db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ? AND is_admin", folder.OwnerTeamID, user.ID).Count(&admins)
+	return admins > 0
+}
+
+// CreateFolder creates a folder for the signed in user, or for one of their
+// teams if teamId is given.
+func (env *Env) CreateFolder(c *gin.Context) {
+	user := currentUser(c)
+	name := strings.TrimSpace(c.PostForm("folderName"))
+	if name == "" || utf8.RuneCountInString(name) > maxFolderNameLength {
+		http.Error(c.Writer, fmt.Sprintf("Folder name must be between 1 and %d characters", maxFolderNameLength), http.StatusBadRequest)
+		return
+	}
+
+	folder := Folder{Name: name, OwnerUserID: &user.ID}
+	if rawTeamId := c.PostForm("teamId"); rawTeamId != "" {
+		teamId, err := strconv.Atoi(rawTeamId)
+		if err != nil {
+			http.Error(c.Writer, "Invalid team", http.StatusBadRequest)
+			return
+		}
+		var inTeam int64
+		env.db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", teamId, user.ID).Count(&inTeam)
+		if inTeam == 0 {
+			http.Error(c.Writer, "You can only create folders for teams you're in", http.StatusForbidden)
+			return
+		}
+		ownerTeamId := uint(teamId)
+		folder.OwnerUserID = nil
+		folder.OwnerTeamID = &ownerTeamId
+	}
+
+	err := env.db.Create(&folder).Error
+	if err != nil {
+		log.Printf("Could not create folder %s: %v", name, err)
+		http.Error(c.Writer, "Could not create folder", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d created folder %d", user.ID, folder.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/boards?folder=%d", folder.ID))
+}
+
+// DeleteFolder deletes the folder. The boards in it aren't affected.
+func (env *Env) DeleteFolder(c *gin.Context) {
+	user := currentUser(c)
+	folderId := c.Params.ByName("folderId")
+
+	folder, err := env.visibleFolder(user, folderId)
+	if err != nil {
+		http.Error(c.Writer, "Folder not found", http.StatusNotFound)
+		return
+	}
+	if !env.canManageFolder(user, folder) {
+		http.Error(c.Writer, "Only team admins can delete a team's folders", http.StatusForbidden)
+		return
+	}
+
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("folder_id = ?", folder.ID).Delete(&BoardFolder{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&folder).Error
+	})
+	if err != nil {
+		log.Printf("Could not delete folder %d: %v", folder.ID, err)
+		http.Error(c.Writer, "Could not delete folder", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d deleted folder %d", user.ID, folder.ID)
+	c.Redirect(http.StatusFound, "/boards")
+}
+
+// MoveBoardToFolder files the board in folderId, taking it out of any other
+// folder with the same owner.
+func (env *Env) MoveBoardToFolder(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	folder, err := env.visibleFolder(user, c.PostForm("folderId"))
+	if err != nil {
+		http.Error(c.Writer, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		sameOwner := tx.Model(&Folder{}).Select("id")
+		if folder.OwnerUserID != nil {
+			sameOwner = sameOwner.Where("owner_user_id = ?", *folder.OwnerUserID)
+		} else {
+			sameOwner = sameOwner.Where("owner_team_id = ?", *folder.OwnerTeamID)
+		}
+		err := tx.Where("board_id = ? AND folder_id IN (?)", board.ID, sameOwner).Delete(&BoardFolder{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&BoardFolder{FolderID: folder.ID, BoardID: board.ID}).Error
+	})
+	if err != nil {
+		log.Printf("Could not move board %d to folder %d: %v", board.ID, folder.ID, err)
+		http.Error(c.Writer, "Could not move board", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d moved board %d to folder %d", user.ID, board.ID, folder.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) RemoveBoardFromFolder(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	folder, err := env.visibleFolder(user, c.PostForm("folderId"))
+	if err != nil {
+		http.Error(c.Writer, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	err = env.db.Where("folder_id = ? AND board_id = ?", folder.ID, board.ID).Delete(&BoardFolder{}).Error
+	if err != nil {
+		log.Printf("Could not remove board %d from folder %d: %v", board.ID, folder.ID, err)
+		http.Error(c.Writer, "Could not remove board from folder", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d removed board %d from folder %d", user.ID, board.ID, folder.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
@@ -1,43 +1,276 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"log"
+	"sync"
 
-	"github.com/google/uuid"
-	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
+// Close codes sent to clients when the server ends their connection. These
+// are in the 4000-4999 range websockets leave for applications.
+const (
+	closeCodeBoardDeleted      = 4001
+	closeCodeMembershipRevoked = 4003
+	closeCodeShareLinkRevoked  = 4004
+)
+
+// membershipChange tells a Hub that a user's role on its board changed. An
+// empty role means they're no longer a member.
+type membershipChange struct {
+	userId uint
+	role   string
+}
+
+// broadcastMessage is a message for everyone on the board but the client
+// that sent it, if any.
+type broadcastMessage struct {
+	sender *Client
+	data   []byte
+}
+
+// closeRequest asks a Hub to disconnect all of its clients and stop.
+type closeRequest struct {
+	code   int
+	reason string
+}
+
 type Hub struct {
 	boardId int
 
+	// Held while a stroke is saved and broadcast, so strokes are broadcast in
+	// the order of the revisions they were saved as.
+	writeMu sync.Mutex
+
 	// Registered clients.
 	clients map[*Client]bool
 
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	broadcast chan broadcastMessage
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Role changes for users who may be connected.
+	memberships chan membershipChange
+
+	// Disconnects everyone watching through a share link, for when it's
+	// turned off or replaced.
+	closeAnonymous chan closeRequest
+
+	// Close request, after which the hub stops running.
+	stop chan closeRequest
+
+	// Closed once the hub has stopped, so clients don't block sending to it.
+	done chan struct{}
 }
 
 func newHub(boardId int) *Hub {
 	return &Hub{
-		boardId:    boardId,
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
+		boardId:        boardId,
+		broadcast:      make(chan broadcastMessage),
+		register:       make(chan *Client),
+		unregister:     make(chan *Client),
+		memberships:    make(chan membershipChange),
+		closeAnonymous: make(chan closeRequest),
+		stop:           make(chan closeRequest),
+		done:           make(chan struct{}),
+		clients:        make(map[*Client]bool),
+	}
+}
+
+// hubRegistry holds the running Hub for each board. Websocket handlers run
+// concurrently, so all access goes through its mutex.
+type hubRegistry struct {
+	mu   sync.Mutex
+	hubs map[int]*Hub
+}
+
+func newHubRegistry() *hubRegistry {
+	return &hubRegistry{hubs: make(map[int]*Hub)}
+}
+
+// getOrCreate returns the hub for boardId, starting one if it isn't running.
+func (r *hubRegistry) getOrCreate(boardId int) *Hub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hub, ok := r.hubs[boardId]
+	if !ok {
+		hub = newHub(boardId)
+		go hub.run()
+		r.hubs[boardId] = hub
+	}
+	return hub
+}
+
+// notifyMembershipChange passes a role change on to boardId's hub, if it's
+// running.
+func (r *hubRegistry) notifyMembershipChange(boardId int, userId uint, role string) {
+	r.mu.Lock()
+	hub, ok := r.hubs[boardId]
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case hub.memberships <- membershipChange{userId: userId, role: role}:
+		case <-hub.done:
+		}
+	}
+}
+
+// closeAnonymous disconnects everyone on boardId's hub who joined with a
+// share link, if it's running.
+func (r *hubRegistry) closeAnonymous(boardId int, code int, reason string) {
+	r.mu.Lock()
+	hub, ok := r.hubs[boardId]
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case hub.closeAnonymous <- closeRequest{code: code, reason: reason}:
+		case <-hub.done:
+		}
+	}
+}
+
+// broadcast sends message to everyone on boardId's hub, if it's running.
+func (r *hubRegistry) broadcast(boardId int, message []byte) {
+	r.mu.Lock()
+	hub, ok := r.hubs[boardId]
+	r.mu.Unlock()
+
+	if ok {
+		select {
+		case hub.broadcast <- broadcastMessage{data: message}:
+		case <-hub.done:
+		}
+	}
+}
+
+// close disconnects everyone on boardId's hub with a close frame and stops
+// it. Nothing happens if the board has no hub running.
+func (r *hubRegistry) close(boardId int, code int, reason string) {
+	r.mu.Lock()
+	hub, ok := r.hubs[boardId]
+	delete(r.hubs, boardId)
+	r.mu.Unlock()
+
+	if ok {
+		hub.stop <- closeRequest{code: code, reason: reason}
+	}
+}
+
+// sendHistory sends a new client what's on the board, or just the lines that
+// changed since the revision it last saw if it's reconnecting.
+func (h *Hub) sendHistory(client *Client) {
+	board := Board{}
+	var lines []Line
+	resume := false
+	// The revision and the lines come from the same snapshot, so the history
+	// doesn't include strokes saved after the revision it says it's at
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Select("id", "revision").First(&board, h.boardId).Error
+		if err != nil {
+			return err
+		}
+		resume = client.since > 0 && client.since <= board.Revision && board.Revision-client.since <= maxResumeGap
+		if resume {
+			return tx.Where("board_id = ? AND revision > ?", h.boardId, client.since).Find(&lines).Error
+		}
+		return tx.Where("board_id = ?", h.boardId).Find(&lines).Error
+	}, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		log.Printf("Could not load history of board %d: %v", h.boardId, err)
+		return
+	}
+
+	start := 0
+	for {
+		end := start + historyChunkSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		payload := historyPayload{Revision: board.Revision, Reset: !resume && start == 0, Lines: make([]historyLine, 0, end-start)}
+		for _, l := range lines[start:end] {
+			var stored struct {
+				Points []Point `json:"points"`
+			}
+			err := json.Unmarshal(l.Points, &stored)
+			if err != nil {
+				log.Printf("Error unmarshalling points of line %s: %v", l.Id, err)
+				continue
+			}
+			payload.Lines = append(payload.Lines, historyLine{Id: l.Id, Points: stored.Points})
+		}
+		message, err := newEnvelope(messageHistory, 0, payload)
+		if err != nil {
+			log.Printf("Error marshalling history: %v", err)
+			return
+		}
+		select {
+		case client.send <- message:
+		case <-client.writerDone:
+			// The client went away part way through, readPump will
+			// unregister it
+			return
+		}
+
+		// Even an empty board gets one message, to tell the client its revision
+		start = end
+		if start >= len(lines) {
+			return
+		}
+	}
+}
+
+// broadcastPresence tells every client who has the board open.
+func (h *Hub) broadcastPresence() {
+	payload := presencePayload{Users: []presenceUser{}}
+	// Users with the board open in several tabs are only listed once
+	seen := make(map[uint]bool)
+	for client := range h.clients {
+		if client.userId == 0 {
+			payload.Anonymous++
+			continue
+		}
+		if seen[client.userId] {
+			continue
+		}
+		seen[client.userId] = true
+		payload.Users = append(payload.Users, presenceUser{Id: client.userId, Username: client.username, Role: client.getRole()})
+	}
+	message, err := newEnvelope(messagePresence, 0, payload)
+	if err != nil {
+		log.Printf("Error marshalling presence: %v", err)
+		return
 	}
+	h.send(message)
 }
 
-type TestMessageAllPointsForUUID struct {
-	Id    uuid.UUID      `json:"id"`
-	Data  datatypes.JSON `json:"data"`
-	Event string         `json:"event"`
+// send queues message for every client, dropping clients that have fallen
+// too far behind.
+func (h *Hub) send(message []byte) {
+	h.sendExcept(message, nil)
+}
+
+// sendExcept queues message for every client but except.
+func (h *Hub) sendExcept(message []byte, except *Client) {
+	for client := range h.clients {
+		if client == except {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			close(client.send)
+			delete(h.clients, client)
+		}
+	}
 }
 
 func (h *Hub) run() {
@@ -45,34 +278,55 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
-			// Grab all points from DB and send
-			var lines []Line
-			db.Where("board_id = ?", h.boardId).Find(&lines)
-			for _, l := range lines {
-				uuidAndPoints := TestMessageAllPointsForUUID{Id: l.Id, Data: l.Points, Event: "New connection"}
-				jsonMessage, err := json.Marshal(uuidAndPoints)
-				if err != nil {
-					log.Printf("Error marshalling uuid and points: %v", err)
-					break
-				}
-				//log.Printf("Sending message to clients %s", jsonMessage)
-				client.send <- jsonMessage
-
-			}
+			h.sendHistory(client)
+			h.broadcastPresence()
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
+				h.broadcastPresence()
 			}
-		case message := <-h.broadcast:
+		case change := <-h.memberships:
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
+				if client.userId != change.userId {
+					continue
+				}
+				if change.role == "" {
+					// Stops readPump saving anything else before the
+					// connection is torn down
+					client.setRole("")
+					client.closeCode = closeCodeMembershipRevoked
+					client.closeReason = "Your access to this board was removed"
 					close(client.send)
 					delete(h.clients, client)
+					continue
 				}
+				client.setRole(change.role)
 			}
+			h.broadcastPresence()
+		case request := <-h.closeAnonymous:
+			for client := range h.clients {
+				if client.userId != 0 {
+					continue
+				}
+				client.setRole("")
+				client.closeCode = request.code
+				client.closeReason = request.reason
+				close(client.send)
+				delete(h.clients, client)
+			}
+			h.broadcastPresence()
+		case request := <-h.stop:
+			for client := range h.clients {
+				client.closeCode = request.code
+				client.closeReason = request.reason
+				close(client.send)
+				delete(h.clients, client)
+			}
+			close(h.done)
+			return
+		case message := <-h.broadcast:
+			h.sendExcept(message.data, message.sender)
 		}
 	}
 }
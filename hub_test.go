@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestHubRegistryGetOrCreateConcurrently(t *testing.T) {
+	hubs := newHubRegistry()
+	found := make(chan *Hub, 50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found <- hubs.getOrCreate(1)
+		}()
+	}
+	wg.Wait()
+	close(found)
+
+	first := <-found
+	for hub := range found {
+		if hub != first {
+			t.Fatalf("Got more than one hub for the same board")
+		}
+	}
+	hubs.close(1, closeCodeBoardDeleted, "Board was deleted")
+}
+
+// readUntil reads messages from conn until one of messageType arrives.
+func readUntil(conn *websocket.Conn, messageType string) error {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		for _, message := range strings.Split(string(data), "\n") {
+			var envelope Envelope
+			if err := json.Unmarshal([]byte(message), &envelope); err != nil {
+				return err
+			}
+			if envelope.Type == messageType {
+				return nil
+			}
+		}
+	}
+}
+
+// Run with go test -race. Clients join and leave the same board at once,
+// going through serveWs like the browser does.
+func TestServeWsConcurrentJoins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	env := newTestEnv(t)
+	r := gin.New()
+	r.GET("/ws", func(c *gin.Context) {
+		if err := env.serveWs(c); err != nil {
+			t.Errorf("serveWs failed: %v", err)
+		}
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?share=token"
+	dialer := websocket.Dialer{Subprotocols: []string{protocolName}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Errorf("Could not connect: %v", err)
+				return
+			}
+			defer conn.Close()
+			// Presence is sent once the hub has registered the client
+			if err := readUntil(conn, messagePresence); err != nil {
+				t.Errorf("No presence after joining: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Everyone has left, so the board can be closed without blocking
+	closed := make(chan struct{})
+	go func() {
+		env.hubs.close(0, closeCodeBoardDeleted, "Board was deleted")
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Hub did not stop")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const invitationExpiry = 14 * 24 * time.Hour
+
+var errInvitationExpired = errors.New("invitation has expired")
+
+// invitationRow is an invitation as listed on a user's page or a board's
+// members page. Username is whoever is on the other end of it.
+type invitationRow struct {
+	ID        uint
+	BoardID   uint
+	BoardName string
+	Username  string
+	Role      string
+	Status    string
+	ExpiresAt time.Time
+}
+
+// withDisplayStatus shows pending invitations past their expiry as expired.
+func withDisplayStatus(invitations []invitationRow) []invitationRow {
+	now := time.Now()
+	for i := range invitations {
+		if invitations[i].Status == InvitationPending && now.After(invitations[i].ExpiresAt) {
+			invitations[i].Status = "expired"
+		}
+	}
+	return invitations
+}
+
+// inviteUserToBoard creates a pending invitation, or renews the one the user
+// already has.
+func (env *Env) inviteUserToBoard(board Board, inviter User, invitee User, role string) error {
+	expiresAt := time.Now().Add(invitationExpiry)
+	result := env.db.Model(&BoardInvitation{}).
+		Where("board_id = ? AND invitee_id = ? AND status = ?", board.ID, invitee.ID, InvitationPending).
+		Updates(map[string]interface{}{"role": role, "inviter_id": inviter.ID, "expires_at": expiresAt})
+	if result.Error != nil || result.RowsAffected > 0 {
+		return result.Error
+	}
+
+	invitation := BoardInvitation{
+		BoardID:   board.ID,
+		InviteeID: invitee.ID,
+		InviterID: inviter.ID,
+		Role:      role,
+		Status:    InvitationPending,
+		ExpiresAt: expiresAt,
+	}
+	return env.db.Create(&invitation).Error
+}
+
+func (env *Env) pendingInvitationsForUser(user User) []invitationRow {
+	invitations := []invitationRow{}
+	env.db.Model(&BoardInvitation{}).
+		Select("board_invitations.id, board_invitations.board_id, boards.board_name, users.username, board_invitations.role, board_invitations.status, board_invitations.expires_at").
+		Joins("JOIN boards ON boards.id = board_invitations.board_id AND boards.deleted_at IS NULL").
+		Joins("JOIN users ON users.id = board_invitations.inviter_id").
+		Where("board_invitations.invitee_id = ? AND board_invitations.status = ? AND board_invitations.expires_at > ?", user.ID, InvitationPending, time.Now()).
+		Order("board_invitations.created_at desc").
+		Scan(&invitations)
+	return invitations
+}
+
+func (env *Env) invitationsForBoard(board Board) []invitationRow {
+	invitations := []invitationRow{}
+	env.db.Model(&BoardInvitation{}).
+		Select("board_invitations.id, board_invitations.board_id, users.username, board_invitations.role, board_invitations.status, board_invitations.expires_at").
+		Joins("JOIN users ON users.id = board_invitations.invitee_id").
+		Where("board_invitations.board_id = ?", board.ID).
+		Order("board_invitations.created_at desc").
+		Scan(&invitations)
+	return withDisplayStatus(invitations)
+}
+
+func (env *Env) AcceptBoardInvitation(c *gin.Context) {
+	user := currentUser(c)
+	invitationId, err := strconv.Atoi(c.Params.ByName("invitationId"))
+	if err != nil {
+		http.Error(c.Writer, "This invitation is no longer available", http.StatusNotFound)
+		return
+	}
+
+	invitation := BoardInvitation{}
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND invitee_id = ? AND status = ?", invitationId, user.ID, InvitationPending).
+			First(&invitation).Error
+		if err != nil {
+			return err
+		}
+		if time.Now().After(invitation.ExpiresAt) {
+			return errInvitationExpired
+		}
+
+		boardMember := BoardMember{BoardID: invitation.BoardID, UserID: user.ID, Role: invitation.Role}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&boardMember).Error; err != nil {
+			return err
+		}
+		return tx.Model(&invitation).Update("status", InvitationAccepted).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, errInvitationExpired) {
+			http.Error(c.Writer, "This invitation is no longer available", http.StatusNotFound)
+			return
+		}
+		log.Printf("Could not accept invitation %d for user %d: %v", invitationId, user.ID, err)
+		http.Error(c.Writer, "Could not accept invitation", http.StatusInternalServerError)
+		return
+	}
+
+	env.membershipChanged(invitation.BoardID, user.ID)
+	log.Printf("User %d accepted invitation to board %d", user.ID, invitation.BoardID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/?boardId=%d", invitation.BoardID))
+}
+
+func (env *Env) DeclineBoardInvitation(c *gin.Context) {
+	user := currentUser(c)
+	invitationId := c.Params.ByName("invitationId")
+
+	result := env.db.Model(&BoardInvitation{}).
+		Where("id = ? AND invitee_id = ? AND status = ?", invitationId, user.ID, InvitationPending).
+		Update("status", InvitationDeclined)
+	if result.Error != nil {
+		log.Printf("Could not decline invitation %s for user %d: %v", invitationId, user.ID, result.Error)
+		http.Error(c.Writer, "Could not decline invitation", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(c.Writer, "This invitation is no longer available", http.StatusNotFound)
+		return
+	}
+	log.Printf("User %d declined invitation %s", user.ID, invitationId)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/user/%d", user.ID))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultInviteExpiry = 7 * 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+)
+
+var errInviteUnusable = errors.New("invite has expired or been used up")
+
+// newRandomToken returns an unguessable token that's safe to put in a URL.
+func newRandomToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func (env *Env) GetBoardInvites(c *gin.Context) {
+	board := currentBoard(c)
+	invites := []BoardInviteLink{}
+	env.db.Where("board_id = ?", board.ID).Order("created_at desc").Find(&invites)
+
+	templateVars := map[string]interface{}{"board": board, "invites": invites, "roles": roles, "host": c.Request.Host, "now": time.Now()}
+	err := templates.ExecuteTemplate(c.Writer, "invites.html", templateVars)
+
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (env *Env) CreateBoardInvite(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	role := c.DefaultPostForm("role", RoleEditor)
+	if !isValidRole(role) {
+		http.Error(c.Writer, fmt.Sprintf("Invalid role %s", role), http.StatusBadRequest)
+		return
+	}
+
+	expiresIn := defaultInviteExpiry
+	if hours := c.PostForm("expiresInHours"); hours != "" {
+		parsedHours, err := strconv.Atoi(hours)
+		if err != nil || parsedHours <= 0 || time.Duration(parsedHours)*time.Hour > maxInviteExpiry {
+			http.Error(c.Writer, fmt.Sprintf("Expiry must be between 1 and %d hours", int(maxInviteExpiry.Hours())), http.StatusBadRequest)
+			return
+		}
+		expiresIn = time.Duration(parsedHours) * time.Hour
+	}
+
+	maxUses := 0
+	if uses := c.PostForm("maxUses"); uses != "" {
+		parsedUses, err := strconv.Atoi(uses)
+		if err != nil || parsedUses < 0 {
+			http.Error(c.Writer, "Max uses must be 0 (unlimited) or more", http.StatusBadRequest)
+			return
+		}
+		maxUses = parsedUses
+	}
+
+	token, err := newRandomToken()
+	if err != nil {
+		log.Printf("Could not generate invite token: %v", err)
+		http.Error(c.Writer, "Could not create invite", http.StatusInternalServerError)
+		return
+	}
+
+	invite := BoardInviteLink{
+		BoardID:     board.ID,
+		Token:       token,
+		Role:        role,
+		CreatedByID: user.ID,
+		ExpiresAt:   time.Now().Add(expiresIn),
+		MaxUses:     maxUses,
+	}
+	err = env.db.Create(&invite).Error
+	if err != nil {
+		log.Printf("Could not create invite for board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not create invite", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d created invite %d for board %d", user.ID, invite.ID, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/invites", board.ID))
+}
+
+func (env *Env) RevokeBoardInvite(c *gin.Context) {
+	board := currentBoard(c)
+	inviteId := c.Params.ByName("inviteId")
+
+	result := env.db.Where("id = ? AND board_id = ?", inviteId, board.ID).Delete(&BoardInviteLink{})
+	if result.Error != nil {
+		log.Printf("Could not revoke invite %s: %v", inviteId, result.Error)
+		http.Error(c.Writer, "Could not revoke invite", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(c.Writer, "Invite not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Revoked invite %s for board %d", inviteId, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d/invites", board.ID))
+}
+
+// JoinBoard adds the signed in user to the board an invite token is for.
+// Users who are already members keep their role and don't use up the invite.
+func (env *Env) JoinBoard(c *gin.Context) {
+	user := currentUser(c)
+	token := c.Params.ByName("token")
+
+	invite := BoardInviteLink{}
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&invite, "token = ?", token).Error
+		if err != nil {
+			return err
+		}
+
+		var existingMembers int64
+		tx.Model(&BoardMember{}).Where("board_id = ? AND user_id = ?", invite.BoardID, user.ID).Count(&existingMembers)
+		if existingMembers > 0 {
+			return nil
+		}
+
+		if time.Now().After(invite.ExpiresAt) || (invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+			return errInviteUnusable
+		}
+
+		boardMember := BoardMember{BoardID: invite.BoardID, UserID: user.ID, Role: invite.Role}
+		if err := tx.Create(&boardMember).Error; err != nil {
+			return err
+		}
+		return tx.Model(&invite).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) || errors.Is(err, errInviteUnusable) {
+			http.Error(c.Writer, "This invite link is invalid or has expired", http.StatusNotFound)
+			return
+		}
+		log.Printf("Could not use invite for user %d: %v", user.ID, err)
+		http.Error(c.Writer, "Could not join board", http.StatusInternalServerError)
+		return
+	}
+
+	env.membershipChanged(invite.BoardID, user.ID)
+	log.Printf("User %d joined board %d with invite %d", user.ID, invite.BoardID, invite.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/?boardId=%d", invite.BoardID))
+}
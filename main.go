@@ -24,24 +24,42 @@ var templates = template.Must(template.ParseGlob("frontend/*.html"))
 type Env struct {
 	db *gorm.DB
 	// TODO: Should this be a map to user ID?
-	// TODO: Add time to live to the session id 
-	sessions map[uuid.UUID]string
+	sessions SessionStore
+	memberships *membershipCache
+	hubs *hubRegistry
+	// How long deleted boards can be restored for before they're purged
+	boardRetention time.Duration
+	// Largest websocket message clients can send, in bytes
+	maxMessageSize int64
 	Environment string
 }
 
 func (env *Env) getUserFromSession(sessionId uuid.UUID) (User, error) {
-		username, ok := env.sessions[sessionId]
-		if ok {
-			log.Printf("Session %s is valid", sessionId.String())
-			user := User{}
-			// TODO: Check the err here
-			env.db.Where("username = ?", username).First(&user)
-			return user, nil
-		} else {
-			return User{}, errors.New(fmt.Sprintf("Session %s not found", sessionId.String()))
-			
+		session, err := env.sessions.Get(sessionId)
+		if err != nil {
+			return User{}, errors.Wrap(err, fmt.Sprintf("Session %s not found", sessionId.String()))
 		}
-
+		now := time.Now()
+		if session.expired(now) {
+			log.Printf("Session %s has expired", sessionId.String())
+			if err := env.sessions.Delete(sessionId); err != nil {
+				log.Printf("Could not delete expired session %s: %v", sessionId.String(), err)
+			}
+			return User{}, ErrSessionExpired
+		}
+		if session.needsRenewal(now) {
+			session.LastSeenAt = now
+			if err := env.sessions.Set(session); err != nil {
+				log.Printf("Could not renew session %s: %v", sessionId.String(), err)
+			}
+		}
+		log.Printf("Session %s is valid", sessionId.String())
+		user := User{}
+		err = env.db.Where("username = ?", session.Username).First(&user).Error
+		if err != nil {
+			return User{}, errors.Wrap(err, fmt.Sprintf("No user for session %s", sessionId.String()))
+		}
+		return user, nil
 }
 
 func getSessionIdFromCookie(c *gin.Context) (uuid.UUID, error) {
@@ -70,38 +88,60 @@ func (env *Env) ServeHome(c *gin.Context) {
 	}
 
 
-	board := Board{}
-	if c.Query("boardId") != "" {
-		db.First(&board, c.Query("boardId"))
+	templateVars := map[string]interface{}{}
+	templateVars["env"] = env.Environment
+	templateVars["maxMessageSize"] = env.maxMessageSize
+	user, err := env.userFromRequest(c)
+	templateVars["loggedIn"] = err == nil
+
+	// Anyone with a board's share link can watch it, signed in or not
+	if shareToken := c.Query("share"); shareToken != "" {
+		board := Board{}
+		err = env.db.First(&board, "share_token = ?", shareToken).Error
+		if err != nil {
+			log.Printf("No board for share token: %v", err)
+			templateVars["error"] = "This share link is invalid or has been turned off"
+		} else {
+			templateVars["boardName"] = board.BoardName
+			templateVars["boardSettings"] = board.settings()
+			templateVars["shareToken"] = shareToken
+			templateVars["canDraw"] = false
+		}
+		err = templates.ExecuteTemplate(writer, "whiteboard.html", templateVars)
+
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
 	}
 
-	templateVars := map[string]interface{}{}
-	sessionId, _ := getSessionIdFromCookie(c)
-	user, err := env.getUserFromSession(sessionId)
-	if err != nil {
-		templateVars["loggedIn"] = false
+	if templateVars["loggedIn"] == false {
 		err = templates.ExecuteTemplate(writer, "whiteboard.html", templateVars)
 
 		if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 		}
 		return;
-	} else {
-		templateVars["loggedIn"] = true
-	}
-	userIsMemberOfBoard := env.isUserMemberOfBoard(user, board)
-	if !userIsMemberOfBoard {
-		templateVars["error"] = "You don't have permission for this board"
-	} else {
-		templateVars["boardName"] = board.BoardName
-		templateVars["boardId"] = board.ID
 	}
 
-	if board.ID == 0 && user.ID != 0 {
-		// User is logged in but hasn't selected a board, not an error
-		templateVars["error"] = nil
+	// A logged in user without a selected board isn't an error, the page asks them to pick one
+	if c.Query("boardId") != "" {
+		board, role, status, err := env.authorizeBoard(user, c.Query("boardId"))
+		if err != nil {
+			log.Printf("Not showing board: %v", err)
+			templateVars["error"] = boardErrorMessage(status)
+			if status == http.StatusForbidden {
+				templateVars["requestAccessBoardId"] = board.ID
+				templateVars["accessRequested"] = env.hasPendingAccessRequest(user, board)
+			}
+		} else {
+			templateVars["boardName"] = board.BoardName
+			templateVars["boardSettings"] = board.settings()
+			templateVars["boardId"] = board.ID
+			templateVars["canDraw"] = roleCanDraw(role)
+			env.recordBoardVisit(user, board)
+		}
 	}
-	templateVars["env"] = env.Environment
 	err = templates.ExecuteTemplate(writer, "whiteboard.html", templateVars)
 
 	if err != nil {
@@ -120,13 +160,32 @@ type Line struct {
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 	Id        uuid.UUID      `gorm:"type:uuid;default:uuid_generate_v4();primary_key"`
 	Points    datatypes.JSON
-	BoardId   int
+	BoardId   int            `gorm:"index;index:idx_lines_board_revision,priority:1"`
+	// The board's Revision when the line last changed
+	Revision  int64          `gorm:"not null;default:0;index:idx_lines_board_revision,priority:2"`
 	Board     Board
 }
 
 type Board struct {
 	gorm.Model
 	BoardName string `gorm:"not null"`
+	// Lets anyone with the token watch the board. Nil when sharing is off.
+	ShareToken *string `gorm:"uniqueIndex"`
+	Description string `gorm:"not null;default:''"`
+	BackgroundColour string `gorm:"not null;default:'#ffffff'"`
+	// One of gridStyles
+	GridStyle string `gorm:"not null;default:none"`
+	// How strokes are drawn on the canvas
+	StrokeColour string `gorm:"not null;default:'#000000'"`
+	StrokeWidth int `gorm:"not null;default:2"`
+	// Templates can be used to start new boards. Only their owners can draw
+	// on them.
+	IsTemplate bool `gorm:"not null;default:false"`
+	// Set for templates everyone in the team can use, nil for personal ones
+	TemplateTeamID *uint `gorm:"index"`
+	// Goes up by one every time a line on the board changes, so reconnecting
+	// clients can be sent just what they missed
+	Revision int64 `gorm:"not null;default:0"`
 }
 
 type User struct {
@@ -135,11 +194,197 @@ type User struct {
 	PasswordHash string `gorm:"not null"`
 }
 
+const (
+	// Owners can draw and manage the board's members
+	RoleOwner = "owner"
+	// Editors can draw
+	RoleEditor = "editor"
+	// Viewers can only watch
+	RoleViewer = "viewer"
+)
+
+var roles = []string{RoleOwner, RoleEditor, RoleViewer}
+
+func isValidRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillBoardOwners makes the earliest member of each board without an
+// owner its owner. Members from before roles existed were all migrated to
+// editors, which would leave nobody able to manage their boards. Trashed
+// boards are included so they can still be restored.
+func backfillBoardOwners(db *gorm.DB) error {
+	result := db.Exec(`UPDATE board_members SET role = ?, updated_at = ? WHERE (board_id, user_id) IN (
+		SELECT DISTINCT ON (board_id) board_id, user_id FROM board_members
+		WHERE board_id NOT IN (SELECT board_id FROM board_members WHERE role = ?)
+		ORDER BY board_id, created_at, user_id)`, RoleOwner, time.Now(), RoleOwner)
+	if result.RowsAffected > 0 {
+		log.Printf("Made the earliest member the owner of %d boards without one", result.RowsAffected)
+	}
+	return result.Error
+}
+
+func roleCanDraw(role string) bool {
+	return role == RoleOwner || role == RoleEditor
+}
+
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleEditor:
+		return 2
+	case RoleViewer:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// highestRole picks the most powerful of roles, or "" if there are none.
+func highestRole(roles []string) string {
+	highest := ""
+	for _, role := range roles {
+		if roleRank(role) > roleRank(highest) {
+			highest = role
+		}
+	}
+	return highest
+}
+
 type BoardMember struct {
 	BoardID uint `gorm:"primaryKey;autoincrement:false"`
 	UserID uint `gorm:"primaryKey;autoincrement:false"`
+	Role string `gorm:"not null;default:editor"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	// Only set when the whole board is deleted, members who are removed or
+	// leave are deleted outright
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// BoardInviteLink lets whoever has the token join the board with Role.
+// Revoking an invite soft deletes it.
+type BoardInviteLink struct {
+	gorm.Model
+	BoardID uint `gorm:"not null;index"`
+	Board Board
+	Token string `gorm:"unique;not null"`
+	Role string `gorm:"not null"`
+	CreatedByID uint `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	// 0 means the invite can be used any number of times
+	MaxUses int `gorm:"not null;default:0"`
+	Uses int `gorm:"not null;default:0"`
+}
+
+type Team struct {
+	gorm.Model
+	Name string `gorm:"not null"`
+	CreatedByID uint `gorm:"not null"`
+}
+
+type TeamMember struct {
+	TeamID uint `gorm:"primaryKey;autoincrement:false"`
+	UserID uint `gorm:"primaryKey;autoincrement:false"`
+	// Admins can add and remove the team's members
+	IsAdmin bool `gorm:"not null;default:false"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// BoardTeamGrant gives everyone in a team Role on a board. Teams can be
+// editors or viewers, owners are always individual BoardMembers.
+type BoardTeamGrant struct {
+	BoardID uint `gorm:"primaryKey;autoincrement:false"`
+	TeamID uint `gorm:"primaryKey;autoincrement:false"`
+	Role string `gorm:"not null"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Only set when the whole board is deleted, like BoardMember
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+)
+
+// BoardInvitation asks a user to join a board. They only become a
+// BoardMember once they accept it.
+type BoardInvitation struct {
+	gorm.Model
+	BoardID uint `gorm:"not null;index"`
+	Board Board
+	InviteeID uint `gorm:"not null;index"`
+	Invitee User
+	InviterID uint `gorm:"not null"`
+	Inviter User
+	Role string `gorm:"not null"`
+	Status string `gorm:"not null;default:pending"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+)
+
+// AccessRequest is a user asking the board's owners to let them in.
+type AccessRequest struct {
+	gorm.Model
+	BoardID uint `gorm:"not null;index"`
+	UserID uint `gorm:"not null;index"`
+	User User
+	Message string
+	Status string `gorm:"not null;default:pending"`
+	// The owner who approved or denied it
+	DecidedByID *uint
+}
+
+// FavouriteBoard is a board the user starred.
+type FavouriteBoard struct {
+	BoardID uint `gorm:"primaryKey;autoincrement:false"`
+	UserID uint `gorm:"primaryKey;autoincrement:false"`
+	CreatedAt time.Time
+}
+
+// BoardVisit records when the user last opened a board.
+type BoardVisit struct {
+	BoardID uint `gorm:"primaryKey;autoincrement:false"`
+	UserID uint `gorm:"primaryKey;autoincrement:false;index:idx_board_visits_user_opened,priority:1"`
+	LastOpenedAt time.Time `gorm:"not null;index:idx_board_visits_user_opened,priority:2"`
+}
+
+// Folder groups boards for a user, or for everyone in a team. Exactly one of
+// OwnerUserID and OwnerTeamID is set.
+type Folder struct {
+	gorm.Model
+	Name string `gorm:"not null"`
+	OwnerUserID *uint `gorm:"index"`
+	OwnerTeamID *uint `gorm:"index"`
+}
+
+// BoardFolder puts a board in a folder. A board is in at most one folder of
+// each owner, but different users and teams can file it differently.
+type BoardFolder struct {
+	FolderID uint `gorm:"primaryKey;autoincrement:false"`
+	BoardID uint `gorm:"primaryKey;autoincrement:false;index"`
+	CreatedAt time.Time
+}
+
+// BoardTag is a free-form label on a board, stored lower case.
+type BoardTag struct {
+	BoardID uint `gorm:"primaryKey;autoincrement:false"`
+	Tag string `gorm:"primaryKey;index"`
+	CreatedAt time.Time
 }
 
 var db *gorm.DB
@@ -147,7 +392,6 @@ var db *gorm.DB
 func main() {
 	// TODO: format check in ws
 
-	// TODO: Auth middleware rather than manual auth in each route
 	flag.Parse()
 	log.SetFlags(0)
 
@@ -178,8 +422,64 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to migrate %v: ", err)
 	}
+	err = backfillBoardOwners(db)
+	if err != nil {
+		log.Fatalf("Failed to backfill board owners: %v", err)
+	}
+	err = db.AutoMigrate(&Session{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+	err = db.AutoMigrate(&BoardInviteLink{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+	err = db.AutoMigrate(&Team{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+	err = db.AutoMigrate(&TeamMember{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+	err = db.AutoMigrate(&BoardTeamGrant{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+	err = db.AutoMigrate(&BoardInvitation{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
 
-	boardHubs := make([]*Hub, 0)
+	err = db.AutoMigrate(&AccessRequest{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+
+	err = db.AutoMigrate(&FavouriteBoard{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+
+	err = db.AutoMigrate(&BoardVisit{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+
+	err = db.AutoMigrate(&Folder{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+
+	err = db.AutoMigrate(&BoardFolder{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
+
+	err = db.AutoMigrate(&BoardTag{})
+	if err != nil {
+		log.Fatalf("Failed to migrate %v: ", err)
+	}
 
 	r := gin.Default()
 	// TODO: Move over to using gin for template rendering
@@ -189,9 +489,16 @@ func main() {
 		environmentToRun = "dev"
 	}
 
-	env := &Env{db: db, sessions: make(map[uuid.UUID]string), Environment: environmentToRun}
+	sessions, err := newSessionStoreFromEnv(db)
+	if err != nil {
+		log.Fatalf("Failed to set up session store: %v", err)
+	}
+
+	env := &Env{db: db, sessions: sessions, memberships: newMembershipCache(), hubs: newHubRegistry(), boardRetention: boardRetentionFromEnv(), maxMessageSize: maxMessageSizeFromEnv(), Environment: environmentToRun}
 
 	log.Printf("Running in %s mode", env.Environment)
+	go env.purgeDeletedBoards()
+	go env.purgeExpiredSessions()
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "Pong",
@@ -199,8 +506,7 @@ func main() {
 	})
 
 	r.GET("/ws", func(context *gin.Context) {
-		// TODO: Surely can just pass a slice?
-		tempBoardHubs, err := env.serveWs(boardHubs, context)
+		err := env.serveWs(context)
 		if err != nil {
 			log.Printf("User couldn't join board")
 			err = templates.ExecuteTemplate(context.Writer, "notAuthorized.html", nil)
@@ -210,21 +516,70 @@ func main() {
 			}
 			return
 		}
-		boardHubs = tempBoardHubs
 	})
 	r.GET("/", env.ServeHome)
-	r.POST("/board", env.PostBoard)
-	r.GET("/board", env.NewBoard)
-	r.GET("/board/:boardId", env.GetBoard)
 	r.POST("/signup", env.CreateUser)
 	r.GET("/signup", env.NewUser)
 	r.POST("/signin", env.SignInUser)
 	r.GET("/signin", env.SignInPage)
-	r.GET("/user/:userId", env.GetUser)
-	r.GET("/boards", env.GetBoardsForUser)
-	r.POST("/board/:boardId/add_user", env.AddUserToBoard)
-	r.POST("/board/:boardId/remove_user", env.RemoveUserFromBoard)
-	r.GET("/board/:boardId/members", env.GetBoardMembers)
+	r.POST("/signout", env.SignOutUser)
+
+	authorized := r.Group("/", env.RequireUser)
+	authorized.POST("/board", env.PostBoard)
+	authorized.GET("/board", env.NewBoard)
+	authorized.GET("/user/:userId", env.GetUser)
+	authorized.GET("/boards", env.GetBoardsForUser)
+
+	boardMembers := authorized.Group("/board/:boardId", env.RequireBoardMember)
+	boardMembers.GET("", env.GetBoard)
+	boardMembers.GET("/members", env.GetBoardMembers)
+	boardMembers.POST("/leave", env.LeaveBoard)
+	boardMembers.POST("/duplicate", env.DuplicateBoard)
+	boardMembers.POST("/favourite", env.FavouriteBoard)
+	boardMembers.POST("/unfavourite", env.UnfavouriteBoard)
+	boardMembers.POST("/move", env.MoveBoardToFolder)
+	boardMembers.POST("/remove_from_folder", env.RemoveBoardFromFolder)
+	boardMembers.POST("/tags", env.AddBoardTag)
+	boardMembers.POST("/tags/remove", env.RemoveBoardTag)
+
+	boardOwners := boardMembers.Group("", env.RequireBoardOwner)
+	boardOwners.POST("/add_user", env.AddUserToBoard)
+	boardOwners.POST("/remove_user", env.RemoveUserFromBoard)
+	boardOwners.POST("/change_role", env.ChangeMemberRole)
+	boardOwners.GET("/invites", env.GetBoardInvites)
+	boardOwners.POST("/invites", env.CreateBoardInvite)
+	boardOwners.POST("/invites/:inviteId/revoke", env.RevokeBoardInvite)
+	boardOwners.POST("/share", env.ShareBoard)
+	boardOwners.POST("/unshare", env.UnshareBoard)
+	boardOwners.POST("/transfer_ownership", env.TransferBoardOwnership)
+	boardOwners.POST("/teams", env.GrantTeamBoardAccess)
+	boardOwners.POST("/teams/:teamId/revoke", env.RevokeTeamBoardAccess)
+	boardOwners.POST("/template", env.MakeBoardTemplate)
+	boardOwners.POST("/untemplate", env.UnmakeBoardTemplate)
+	boardOwners.POST("/access_requests/:requestId/approve", env.ApproveAccessRequest)
+	boardOwners.POST("/access_requests/:requestId/deny", env.DenyAccessRequest)
+	boardOwners.PATCH("", env.UpdateBoardSettings)
+	// HTML forms can't send PATCH
+	boardOwners.POST("/settings", env.UpdateBoardSettings)
+	boardOwners.DELETE("", env.DeleteBoard)
+	// HTML forms can't send DELETE
+	boardOwners.POST("/delete", env.DeleteBoard)
+	authorized.GET("/join/:token", env.JoinBoard)
+	authorized.POST("/board/:boardId/request_access", env.RequestBoardAccess)
+	authorized.POST("/folders", env.CreateFolder)
+	authorized.POST("/folders/:folderId/delete", env.DeleteFolder)
+	authorized.GET("/trash", env.GetTrash)
+	authorized.POST("/trash/:boardId/restore", env.RestoreBoard)
+	authorized.POST("/invitations/:invitationId/accept", env.AcceptBoardInvitation)
+	authorized.POST("/invitations/:invitationId/decline", env.DeclineBoardInvitation)
+	authorized.GET("/teams", env.GetTeamsForUser)
+	authorized.POST("/teams", env.CreateTeam)
+
+	teamMembers := authorized.Group("/team/:teamId", env.RequireTeamMember)
+	teamMembers.GET("", env.GetTeam)
+	teamAdmins := teamMembers.Group("", env.RequireTeamAdmin)
+	teamAdmins.POST("/add_user", env.AddUserToTeam)
+	teamAdmins.POST("/remove_user", env.RemoveUserFromTeam)
 	port := os.Getenv("PORT")
 	r.Run(":" + port)
 }
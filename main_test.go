@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestEnv returns an Env with an in-memory session store and a database
+// that builds queries without sending them anywhere, so handlers can run
+// without postgres. Queries return no rows and no errors, and transactions
+// fail to begin.
+func newTestEnv(t *testing.T) *Env {
+	t.Helper()
+	testDb, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 sslmode=disable connect_timeout=1"), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("Could not open test database: %v", err)
+	}
+	// The hub and clients use the package level db
+	db = testDb
+	return &Env{db: testDb, sessions: NewMemorySessionStore(), memberships: newMembershipCache(), hubs: newHubRegistry(), maxMessageSize: defaultMaxMessageSize}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long a cached membership result is trusted. Other instances can't
+// invalidate our cache, so this bounds how stale it can get.
+const membershipCacheTTL = 30 * time.Second
+
+type membershipKey struct {
+	boardId uint
+	userId  uint
+}
+
+type membershipCacheEntry struct {
+	// Empty when the user isn't a member
+	role      string
+	expiresAt time.Time
+}
+
+// membershipCache remembers boardRoleForUser results.
+type membershipCache struct {
+	mu      sync.Mutex
+	entries map[membershipKey]membershipCacheEntry
+}
+
+func newMembershipCache() *membershipCache {
+	return &membershipCache{entries: make(map[membershipKey]membershipCacheEntry)}
+}
+
+func (m *membershipCache) get(boardId uint, userId uint) (role string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := membershipKey{boardId: boardId, userId: userId}
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return "", false
+	}
+	return entry.role, true
+}
+
+func (m *membershipCache) set(boardId uint, userId uint, role string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := membershipKey{boardId: boardId, userId: userId}
+	m.entries[key] = membershipCacheEntry{role: role, expiresAt: time.Now().Add(membershipCacheTTL)}
+}
+
+func (m *membershipCache) invalidate(boardId uint, userId uint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, membershipKey{boardId: boardId, userId: userId})
+}
+
+// invalidateBoard forgets every cached result for boardId.
+func (m *membershipCache) invalidateBoard(boardId uint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.entries {
+		if key.boardId == boardId {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+const (
+	userContextKey      = "user"
+	boardContextKey     = "board"
+	boardRoleContextKey = "boardRole"
+)
+
+// userFromRequest resolves the signed in user from the sessionId cookie.
+func (env *Env) userFromRequest(c *gin.Context) (User, error) {
+	sessionId, err := getSessionIdFromCookie(c)
+	if err != nil {
+		return User{}, err
+	}
+	return env.getUserFromSession(sessionId)
+}
+
+// RequireUser stores the signed in user in the context for currentUser.
+// Requests without a valid session are redirected to /signin, or get a 401
+// if they asked for JSON.
+func (env *Env) RequireUser(c *gin.Context) {
+	user, err := env.userFromRequest(c)
+	if err != nil {
+		if wantsJSON(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not signed in"})
+			return
+		}
+		c.Redirect(http.StatusFound, "/signin")
+		c.Abort()
+		return
+	}
+	c.Set(userContextKey, user)
+	c.Next()
+}
+
+// currentUser returns the user stored by RequireUser. Only call it from
+// handlers behind that middleware.
+func currentUser(c *gin.Context) User {
+	return c.MustGet(userContextKey).(User)
+}
+
+// RequireBoardMember stores the :boardId board in the context for
+// currentBoard, responding 400 for a malformed id, 404 for a missing board
+// and 403 if the user isn't a member. It must run after RequireUser.
+func (env *Env) RequireBoardMember(c *gin.Context) {
+	board, role, status, err := env.authorizeBoard(currentUser(c), c.Param("boardId"))
+	if err != nil {
+		log.Printf("Rejecting board request: %v", err)
+		abortWithError(c, status, err)
+		return
+	}
+	c.Set(boardContextKey, board)
+	c.Set(boardRoleContextKey, role)
+	c.Next()
+}
+
+// RequireBoardOwner refuses members who aren't owners of the board. It must
+// run after RequireBoardMember.
+func (env *Env) RequireBoardOwner(c *gin.Context) {
+	if currentBoardRole(c) != RoleOwner {
+		board := currentBoard(c)
+		abortWithError(c, http.StatusForbidden, errors.New(fmt.Sprintf("Only owners can manage board %d", board.ID)))
+		return
+	}
+	c.Next()
+}
+
+// currentBoard returns the board stored by RequireBoardMember.
+func currentBoard(c *gin.Context) Board {
+	return c.MustGet(boardContextKey).(Board)
+}
+
+// currentBoardRole returns the user's role on currentBoard.
+func currentBoardRole(c *gin.Context) string {
+	return c.GetString(boardRoleContextKey)
+}
+
+// abortWithError responds with status, as JSON for API clients or the
+// notAuthorized page for browsers that were refused access.
+func abortWithError(c *gin.Context, status int, err error) {
+	if wantsJSON(c) {
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.Abort()
+	if status == http.StatusForbidden {
+		c.Status(status)
+		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
+		if err != nil {
+			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Error(c.Writer, http.StatusText(status), status)
+}
+
+// wantsJSON reports whether the request is from an API client rather than a
+// browser page.
+func wantsJSON(c *gin.Context) bool {
+	if c.ContentType() == gin.MIMEJSON {
+		return true
+	}
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
+}
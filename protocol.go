@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// The websocket protocol. Every message either way is an Envelope, and the
+// server may put several in one frame separated by newlines. Clients ask for
+// a version with the websocket subprotocol, e.g. whiteboard.v1. Clients that
+// don't ask get the current version.
+const (
+	protocolVersion = 1
+	protocolName    = "whiteboard.v1"
+)
+
+// Message types.
+const (
+	// Client to server, and relayed to the board's other clients
+	messageStrokeStart = "stroke-start"
+	messagePoint       = "point"
+	messageSegment     = "segment"
+	messageStrokeEnd   = "stroke-end"
+
+	// Server to client
+	messageAck      = "ack"
+	messageNack     = "nack"
+	messageHistory  = "history"
+	messageError    = "error"
+	messagePresence = "presence"
+	messageSettings = "settings"
+)
+
+// Codes sent in error messages.
+const (
+	errorInvalidMessage     = "invalid-message"
+	errorInvalidSeq         = "invalid-seq"
+	errorNotSaved           = "not-saved"
+	errorUnknownType        = "unknown-type"
+	errorUnsupportedVersion = "unsupported-version"
+	errorForbidden          = "forbidden"
+)
+
+// How many lines go in each history message sent to a new client.
+const historyChunkSize = 200
+
+// Clients reconnecting more than this many revisions behind get the whole
+// board again rather than the lines that changed.
+const maxResumeGap = 5000
+
+// Envelope wraps every websocket message. Clients number their messages with
+// Seq, which has to increase. Each message gets exactly one ack or nack with
+// its Seq, in the order they were sent. An ack means the message was saved
+// and passed on to everyone else on the board. Clients don't get their own
+// strokes back, just the ack. Strokes from others arrive in revision order,
+// after the history.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// strokePayload is a point on a stroke, for stroke-start and point messages.
+// Revision is the board revision the server saved it as. Clients don't send
+// it.
+type strokePayload struct {
+	Id       uuid.UUID `json:"id"`
+	Point    Point     `json:"point"`
+	Revision int64     `json:"revision,omitempty"`
+}
+
+// segmentPayload is a batch of points on a stroke, saved and relayed as one
+// message. A stroke can be sent as segments instead of a stroke-start and a
+// point message per point, and the first segment starts the stroke. How many
+// points fit in one is limited by the server's maximum message size.
+type segmentPayload struct {
+	Id       uuid.UUID `json:"id"`
+	Points   []Point   `json:"points"`
+	Revision int64     `json:"revision,omitempty"`
+}
+
+type strokeEndPayload struct {
+	Id uuid.UUID `json:"id"`
+}
+
+type historyLine struct {
+	Id     uuid.UUID `json:"id"`
+	Points []Point   `json:"points"`
+}
+
+// historyPayload is part of what's on the board at Revision, sent when a
+// client connects. Clients that connect with ?since=REVISION are only sent
+// the lines changed after it, which replace what they have. Otherwise the
+// first message has Reset set and the client should clear the board.
+type historyPayload struct {
+	Revision int64         `json:"revision"`
+	Reset    bool          `json:"reset"`
+	Lines    []historyLine `json:"lines"`
+}
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type presenceUser struct {
+	Id       uint   `json:"id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// presencePayload is everyone who has the board open. People watching
+// through a share link are only counted.
+type presencePayload struct {
+	Users     []presenceUser `json:"users"`
+	Anonymous int            `json:"anonymous"`
+}
+
+// newEnvelope encodes a message of the current protocol version.
+func newEnvelope(messageType string, seq uint64, payload interface{}) ([]byte, error) {
+	encodedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Type: messageType, Version: protocolVersion, Seq: seq, Payload: encodedPayload})
+}
+
+// ackEnvelope encodes an ack for the client's message seq.
+func ackEnvelope(seq uint64) []byte {
+	encoded, _ := json.Marshal(Envelope{Type: messageAck, Version: protocolVersion, Seq: seq})
+	return encoded
+}
+
+// nackEnvelope encodes the reason the client's message seq was rejected.
+func nackEnvelope(seq uint64, code string, message string) []byte {
+	// Marshalling strings can't fail
+	encoded, _ := newEnvelope(messageNack, seq, errorPayload{Code: code, Message: message})
+	return encoded
+}
+
+// errorEnvelope encodes an error about a message without a usable seq.
+func errorEnvelope(code string, message string) []byte {
+	encoded, _ := newEnvelope(messageError, 0, errorPayload{Code: code, Message: message})
+	return encoded
+}
+
+// negotiateProtocol picks the protocol version the client asked for, if we
+// support it.
+func negotiateProtocol(r *http.Request) (int, bool) {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return protocolVersion, true
+	}
+	for _, protocol := range requested {
+		if protocol == protocolName {
+			return protocolVersion, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// Sessions end this long after sign in, however active they are.
+	sessionAbsoluteTimeout = 7 * 24 * time.Hour
+
+	// Sessions end after this long without a request.
+	sessionIdleTimeout = 12 * time.Hour
+
+	// How often an active session has its LastSeenAt bumped, so that not
+	// every request writes to the store.
+	sessionRenewInterval = time.Minute
+
+	// How often sessions that expired without being used again are removed.
+	sessionPurgeInterval = time.Hour
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session expired")
+)
+
+// SessionStore keeps track of which user a session id was issued to.
+type SessionStore interface {
+	// Get returns the session for sessionId, or ErrSessionNotFound.
+	Get(sessionId uuid.UUID) (Session, error)
+	// Set creates or replaces the session with the same Id.
+	Set(session Session) error
+	Delete(sessionId uuid.UUID) error
+	// DeleteExpired removes sessions that have expired by now, returning how
+	// many were removed.
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+// Session is the row stored by PostgresSessionStore.
+type Session struct {
+	Id         uuid.UUID `gorm:"type:uuid;primary_key"`
+	Username   string    `gorm:"not null"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	LastSeenAt time.Time `gorm:"not null"`
+}
+
+func newSession(username string) Session {
+	now := time.Now()
+	return Session{Id: uuid.New(), Username: username, CreatedAt: now, LastSeenAt: now}
+}
+
+func (s Session) expiresAt() time.Time {
+	absoluteExpiry := s.CreatedAt.Add(sessionAbsoluteTimeout)
+	idleExpiry := s.LastSeenAt.Add(sessionIdleTimeout)
+	if idleExpiry.Before(absoluteExpiry) {
+		return idleExpiry
+	}
+	return absoluteExpiry
+}
+
+func (s Session) expired(now time.Time) bool {
+	return !now.Before(s.expiresAt())
+}
+
+func (s Session) needsRenewal(now time.Time) bool {
+	return now.Sub(s.LastSeenAt) >= sessionRenewInterval
+}
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost on
+// restart and aren't shared between instances, so it's only meant for dev.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[uuid.UUID]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[uuid.UUID]Session)}
+}
+
+func (s *MemorySessionStore) Get(sessionId uuid.UUID) (Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) Set(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.Id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(sessionId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionId)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for id, session := range s.sessions {
+		if session.expired(now) {
+			delete(s.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// PostgresSessionStore keeps sessions in the sessions table.
+type PostgresSessionStore struct {
+	db *gorm.DB
+}
+
+func NewPostgresSessionStore(db *gorm.DB) *PostgresSessionStore {
+	return &PostgresSessionStore{db: db}
+}
+
+func (s *PostgresSessionStore) Get(sessionId uuid.UUID) (Session, error) {
+	session := Session{}
+	err := s.db.First(&session, "id = ?", sessionId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return Session{}, ErrSessionNotFound
+		}
+		return Session{}, errors.Wrap(err, "could not load session")
+	}
+	return session, nil
+}
+
+func (s *PostgresSessionStore) Set(session Session) error {
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"username", "updated_at", "last_seen_at"}),
+	}).Create(&session).Error
+	return errors.Wrap(err, "could not save session")
+}
+
+func (s *PostgresSessionStore) Delete(sessionId uuid.UUID) error {
+	err := s.db.Delete(&Session{}, "id = ?", sessionId).Error
+	return errors.Wrap(err, "could not delete session")
+}
+
+func (s *PostgresSessionStore) DeleteExpired(now time.Time) (int64, error) {
+	result := s.db.Where("last_seen_at <= ? OR created_at <= ?", now.Add(-sessionIdleTimeout), now.Add(-sessionAbsoluteTimeout)).Delete(&Session{})
+	return result.RowsAffected, errors.Wrap(result.Error, "could not delete expired sessions")
+}
+
+// RedisSessionStore keeps sessions as JSON in redis under "session:<id>"
+// keys, which redis expires on its own once the session times out.
+type RedisSessionStore struct {
+	client *redis.Client
+}
+
+func NewRedisSessionStore(client *redis.Client) *RedisSessionStore {
+	return &RedisSessionStore{client: client}
+}
+
+func redisSessionKey(sessionId uuid.UUID) string {
+	return fmt.Sprintf("session:%s", sessionId.String())
+}
+
+func (s *RedisSessionStore) Get(sessionId uuid.UUID) (Session, error) {
+	value, err := s.client.Get(context.Background(), redisSessionKey(sessionId)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return Session{}, ErrSessionNotFound
+		}
+		return Session{}, errors.Wrap(err, "could not load session")
+	}
+	session := Session{}
+	if err := json.Unmarshal(value, &session); err != nil {
+		return Session{}, errors.Wrap(err, "could not decode session")
+	}
+	return session, nil
+}
+
+func (s *RedisSessionStore) Set(session Session) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return errors.Wrap(err, "could not encode session")
+	}
+	ttl := time.Until(session.expiresAt())
+	if ttl <= 0 {
+		return s.Delete(session.Id)
+	}
+	err = s.client.Set(context.Background(), redisSessionKey(session.Id), value, ttl).Err()
+	return errors.Wrap(err, "could not save session")
+}
+
+func (s *RedisSessionStore) Delete(sessionId uuid.UUID) error {
+	err := s.client.Del(context.Background(), redisSessionKey(sessionId)).Err()
+	return errors.Wrap(err, "could not delete session")
+}
+
+// DeleteExpired has nothing to do, redis expires sessions itself.
+func (s *RedisSessionStore) DeleteExpired(now time.Time) (int64, error) {
+	return 0, nil
+}
+
+// purgeExpiredSessions removes sessions that expired without being used
+// again, which would otherwise never be deleted, every sessionPurgeInterval.
+func (env *Env) purgeExpiredSessions() {
+	ticker := time.NewTicker(sessionPurgeInterval)
+	defer ticker.Stop()
+	for {
+		deleted, err := env.sessions.DeleteExpired(time.Now())
+		if err != nil {
+			log.Printf("Could not purge expired sessions: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Purged %d expired sessions", deleted)
+		}
+		<-ticker.C
+	}
+}
+
+// newSessionStoreFromEnv picks the session backend from SESSION_STORE
+// (memory, postgres or redis). Defaults to postgres.
+func newSessionStoreFromEnv(db *gorm.DB) (SessionStore, error) {
+	backend := os.Getenv("SESSION_STORE")
+	if backend == "" {
+		backend = "postgres"
+	}
+	log.Printf("Using %s session store", backend)
+
+	switch backend {
+	case "memory":
+		return NewMemorySessionStore(), nil
+	case "postgres":
+		return NewPostgresSessionStore(db), nil
+	case "redis":
+		options, err := redis.ParseURL(os.Getenv("REDIS_URL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid REDIS_URL")
+		}
+		client := redis.NewClient(options)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			return nil, errors.Wrap(err, "could not connect to redis")
+		}
+		return NewRedisSessionStore(client), nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown session store %s", backend))
+	}
+}
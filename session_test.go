@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run with go test -race. Sign ins, sign outs and session checks all happen
+// at once on the same store.
+func TestMemorySessionStoreConcurrentAccess(t *testing.T) {
+	store := NewMemorySessionStore()
+	sessions := make([]Session, 50)
+	for i := range sessions {
+		sessions[i] = newSession(fmt.Sprintf("user%d", i))
+	}
+
+	var wg sync.WaitGroup
+	for i := range sessions {
+		session := sessions[i]
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := store.Set(session); err != nil {
+					t.Errorf("Set failed: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := store.Get(session.Id)
+				if err != nil && err != ErrSessionNotFound {
+					t.Errorf("Get failed: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := store.Delete(session.Id); err != nil {
+					t.Errorf("Delete failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Checking a session can renew it or delete it if it has expired, so
+// concurrent checks of the same sessions write to the store too.
+func TestGetUserFromSessionConcurrentAccess(t *testing.T) {
+	env := newTestEnv(t)
+	now := time.Now()
+
+	renewing := newSession("renewing")
+	renewing.LastSeenAt = now.Add(-2 * sessionRenewInterval)
+	expired := newSession("expired")
+	expired.CreatedAt = now.Add(-2 * sessionAbsoluteTimeout)
+	expired.LastSeenAt = expired.CreatedAt
+	fresh := newSession("fresh")
+	for _, session := range []Session{renewing, expired, fresh} {
+		if err := env.sessions.Set(session); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for _, session := range []Session{renewing, expired, fresh} {
+				env.getUserFromSession(session.Id)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			// Signing in and out at the same time
+			session := newSession("other")
+			env.sessions.Set(session)
+			env.getUserFromSession(session.Id)
+			env.sessions.Delete(session.Id)
+		}()
+	}
+	wg.Wait()
+
+	if _, err := env.getUserFromSession(expired.Id); err == nil {
+		t.Errorf("Expired session %s was accepted", expired.Id)
+	}
+	if _, err := env.sessions.Get(expired.Id); err != ErrSessionNotFound {
+		t.Errorf("Expired session %s was not deleted: %v", expired.Id, err)
+	}
+	if _, err := env.getUserFromSession(fresh.Id); err != nil {
+		t.Errorf("Valid session %s was rejected: %v", fresh.Id, err)
+	}
+}
+
+func TestMemorySessionStoreDeleteExpired(t *testing.T) {
+	store := NewMemorySessionStore()
+	now := time.Now()
+
+	idle := newSession("idle")
+	idle.LastSeenAt = now.Add(-sessionIdleTimeout)
+	old := newSession("old")
+	old.CreatedAt = now.Add(-sessionAbsoluteTimeout)
+	active := newSession("active")
+	for _, session := range []Session{idle, old, active} {
+		if err := store.Set(session); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	deleted, err := store.DeleteExpired(now)
+	if err != nil {
+		t.Fatalf("DeleteExpired failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Deleted %d sessions, want 2", deleted)
+	}
+	for _, session := range []Session{idle, old} {
+		if _, err := store.Get(session.Id); err != ErrSessionNotFound {
+			t.Errorf("Expired session %s was kept", session.Username)
+		}
+	}
+	if _, err := store.Get(active.Id); err != nil {
+		t.Errorf("Active session was deleted: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxTagLength    = 50
+	maxTagsPerBoard = 20
+)
+
+// normalizeTag makes tags that only differ by case or surrounding space the
+// same.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func (env *Env) tagsForBoard(board Board) []string {
+	tags := []string{}
+	env.db.Model(&BoardTag{}).Where("board_id = ?", board.ID).Order("tag").Pluck("tag", &tags)
+	return tags
+}
+
+// tagsForUser returns every tag used on boards the user can open.
+func (env *Env) tagsForUser(user User) []string {
+	tags := []string{}
+	env.db.Model(&BoardTag{}).Distinct("tag").
+		Where("board_id IN (?)", env.db.Model(&Board{}).Select("id").Where("id IN (?)", env.accessibleBoardIds(user))).
+		Order("tag").
+		Pluck("tag", &tags)
+	return tags
+}
+
+// AddBoardTag tags the board. Anyone who can draw on it can tag it.
+func (env *Env) AddBoardTag(c *gin.Context) {
+	board := currentBoard(c)
+	if !roleCanDraw(currentBoardRole(c)) {
+		http.Error(c.Writer, "Viewers can't tag this board", http.StatusForbidden)
+		return
+	}
+
+	tag := normalizeTag(c.PostForm("tag"))
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+		http.Error(c.Writer, fmt.Sprintf("Tags must be between 1 and %d characters", maxTagLength), http.StatusBadRequest)
+		return
+	}
+	var tagCount int64
+	env.db.Model(&BoardTag{}).Where("board_id = ?", board.ID).Count(&tagCount)
+	if tagCount >= maxTagsPerBoard {
+		http.Error(c.Writer, fmt.Sprintf("Boards can have at most %d tags", maxTagsPerBoard), http.StatusConflict)
+		return
+	}
+
+	err := env.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&BoardTag{BoardID: board.ID, Tag: tag}).Error
+	if err != nil {
+		log.Printf("Could not tag board %d with %s: %v", board.ID, tag, err)
+		http.Error(c.Writer, "Could not tag board", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Tagged board %d with %s", board.ID, tag)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) RemoveBoardTag(c *gin.Context) {
+	board := currentBoard(c)
+	if !roleCanDraw(currentBoardRole(c)) {
+		http.Error(c.Writer, "Viewers can't untag this board", http.StatusForbidden)
+		return
+	}
+
+	tag := normalizeTag(c.PostForm("tag"))
+	err := env.db.Where("board_id = ? AND tag = ?", board.ID, tag).Delete(&BoardTag{}).Error
+	if err != nil {
+		log.Printf("Could not remove tag %s from board %d: %v", tag, board.ID, err)
+		http.Error(c.Writer, "Could not remove tag", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Removed tag %s from board %d", tag, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	teamContextKey       = "team"
+	teamMemberContextKey = "teamMember"
+	maxTeamNameLength    = 100
+)
+
+// RequireTeamMember stores the :teamId team and the user's TeamMember row in
+// the context. It must run after RequireUser.
+func (env *Env) RequireTeamMember(c *gin.Context) {
+	user := currentUser(c)
+	teamId, err := strconv.Atoi(c.Param("teamId"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.New(fmt.Sprintf("Invalid team id %s", c.Param("teamId"))))
+		return
+	}
+
+	team := Team{}
+	err = env.db.First(&team, teamId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			abortWithError(c, http.StatusNotFound, errors.New(fmt.Sprintf("Team %d not found", teamId)))
+			return
+		}
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, "could not load team"))
+		return
+	}
+
+	teamMember := TeamMember{}
+	err = env.db.First(&teamMember, "team_id = ? AND user_id = ?", team.ID, user.ID).Error
+	if err != nil {
+		abortWithError(c, http.StatusForbidden, errors.New(fmt.Sprintf("User %d is not in team %d", user.ID, team.ID)))
+		return
+	}
+
+	c.Set(teamContextKey, team)
+	c.Set(teamMemberContextKey, teamMember)
+	c.Next()
+}
+
+// RequireTeamAdmin refuses team members who aren't admins. It must run after
+// RequireTeamMember.
+func (env *Env) RequireTeamAdmin(c *gin.Context) {
+	if !currentTeamMember(c).IsAdmin {
+		abortWithError(c, http.StatusForbidden, errors.New(fmt.Sprintf("Only admins can manage team %d", currentTeam(c).ID)))
+		return
+	}
+	c.Next()
+}
+
+func currentTeam(c *gin.Context) Team {
+	return c.MustGet(teamContextKey).(Team)
+}
+
+func currentTeamMember(c *gin.Context) TeamMember {
+	return c.MustGet(teamMemberContextKey).(TeamMember)
+}
+
+// teamsForUser returns every team the user is in.
+func (env *Env) teamsForUser(user User) []Team {
+	teams := []Team{}
+	env.db.Joins("JOIN team_members ON team_members.team_id = teams.id").Where("team_members.user_id = ?", user.ID).Order("teams.name").Find(&teams)
+	return teams
+}
+
+func (env *Env) GetTeamsForUser(c *gin.Context) {
+	user := currentUser(c)
+	templateVars := map[string]interface{}{"teams": env.teamsForUser(user)}
+	err := templates.ExecuteTemplate(c.Writer, "teams.html", templateVars)
+
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (env *Env) CreateTeam(c *gin.Context) {
+	user := currentUser(c)
+	name := strings.TrimSpace(c.PostForm("teamName"))
+	if name == "" || utf8.RuneCountInString(name) > maxTeamNameLength {
+		http.Error(c.Writer, fmt.Sprintf("Team name must be between 1 and %d characters", maxTeamNameLength), http.StatusBadRequest)
+		return
+	}
+
+	team := Team{Name: name, CreatedByID: user.ID}
+	err := env.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&team).Error; err != nil {
+			return err
+		}
+		return tx.Create(&TeamMember{TeamID: team.ID, UserID: user.ID, IsAdmin: true}).Error
+	})
+	if err != nil {
+		log.Printf("Could not create team %s: %v", name, err)
+		http.Error(c.Writer, "Could not create team", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d created team %d", user.ID, team.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/team/%d", team.ID))
+}
+
+// teamMemberRow is a member as listed on the team page.
+type teamMemberRow struct {
+	ID       uint
+	Username string
+	IsAdmin  bool
+}
+
+// teamBoardRow is a board the team has been granted access to.
+type teamBoardRow struct {
+	ID        uint
+	BoardName string
+	Role      string
+}
+
+func (env *Env) GetTeam(c *gin.Context) {
+	team := currentTeam(c)
+
+	members := []teamMemberRow{}
+	env.db.Table("users").Select("users.id, users.username, team_members.is_admin").Joins("JOIN team_members ON team_members.user_id = users.id").Where("team_members.team_id = ?", team.ID).Order("users.username").Find(&members)
+
+	boards := []teamBoardRow{}
+	env.db.Model(&Board{}).Select("boards.id, boards.board_name, board_team_grants.role").Joins("JOIN board_team_grants ON board_team_grants.board_id = boards.id AND board_team_grants.deleted_at IS NULL").Where("board_team_grants.team_id = ?", team.ID).Order("boards.board_name").Scan(&boards)
+
+	templateVars := map[string]interface{}{"team": team, "members": members, "boards": boards, "isAdmin": currentTeamMember(c).IsAdmin}
+	err := templates.ExecuteTemplate(c.Writer, "team.html", templateVars)
+
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (env *Env) AddUserToTeam(c *gin.Context) {
+	team := currentTeam(c)
+	username := c.PostForm("userToAdd")
+
+	userToAdd := User{}
+	err := env.db.First(&userToAdd, "username = ?", username).Error
+	if err != nil {
+		http.Error(c.Writer, fmt.Sprintf("No user called %s", username), http.StatusNotFound)
+		return
+	}
+
+	teamMember := TeamMember{TeamID: team.ID, UserID: userToAdd.ID, IsAdmin: c.PostForm("isAdmin") == "on"}
+	err = env.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&teamMember).Error
+	if err != nil {
+		log.Printf("Could not add user %d to team %d: %v", userToAdd.ID, team.ID, err)
+		http.Error(c.Writer, "Could not add user to team", http.StatusInternalServerError)
+		return
+	}
+	env.teamMembershipChanged(team.ID, userToAdd.ID)
+	log.Printf("Added user %d to team %d", userToAdd.ID, team.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/team/%d", team.ID))
+}
+
+func (env *Env) RemoveUserFromTeam(c *gin.Context) {
+	team := currentTeam(c)
+	username := c.PostForm("userToRemove")
+
+	userToRemove := User{}
+	teamMember := TeamMember{}
+	err := env.db.First(&userToRemove, "username = ?", username).Error
+	if err == nil {
+		err = env.db.First(&teamMember, "team_id = ? AND user_id = ?", team.ID, userToRemove.ID).Error
+	}
+	if err != nil {
+		http.Error(c.Writer, fmt.Sprintf("%s is not in this team", username), http.StatusNotFound)
+		return
+	}
+
+	if teamMember.IsAdmin {
+		var admins int64
+		env.db.Model(&TeamMember{}).Where("team_id = ? AND is_admin", team.ID).Count(&admins)
+		if admins <= 1 {
+			http.Error(c.Writer, "Can't remove the team's only admin", http.StatusConflict)
+			return
+		}
+	}
+
+	err = env.db.Delete(&teamMember).Error
+	if err != nil {
+		log.Printf("Could not remove user %d from team %d: %v", userToRemove.ID, team.ID, err)
+		http.Error(c.Writer, "Could not remove user from team", http.StatusInternalServerError)
+		return
+	}
+	env.teamMembershipChanged(team.ID, userToRemove.ID)
+	log.Printf("Removed user %d from team %d", userToRemove.ID, team.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/team/%d", team.ID))
+}
+
+// GrantTeamBoardAccess gives one of the owner's teams access to the board, or
+// changes the role it already has.
+func (env *Env) GrantTeamBoardAccess(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+	role := c.PostForm("role")
+	if role != RoleEditor && role != RoleViewer {
+		http.Error(c.Writer, "Teams can only be editors or viewers", http.StatusBadRequest)
+		return
+	}
+
+	teamId, err := strconv.Atoi(c.PostForm("teamId"))
+	if err != nil {
+		http.Error(c.Writer, "Invalid team", http.StatusBadRequest)
+		return
+	}
+	var inTeam int64
+	env.db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", teamId, user.ID).Count(&inTeam)
+	if inTeam == 0 {
+		http.Error(c.Writer, "You can only share boards with teams you're in", http.StatusForbidden)
+		return
+	}
+
+	grant := BoardTeamGrant{BoardID: board.ID, TeamID: uint(teamId), Role: role}
+	err = env.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "board_id"}, {Name: "team_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role", "updated_at"}),
+	}).Create(&grant).Error
+	if err != nil {
+		log.Printf("Could not grant team %d access to board %d: %v", teamId, board.ID, err)
+		http.Error(c.Writer, "Could not share board with team", http.StatusInternalServerError)
+		return
+	}
+	env.teamBoardAccessChanged(uint(teamId), board.ID)
+	log.Printf("Team %d is now %s of board %d", teamId, role, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) RevokeTeamBoardAccess(c *gin.Context) {
+	board := currentBoard(c)
+	teamId, err := strconv.Atoi(c.Params.ByName("teamId"))
+	if err != nil {
+		http.Error(c.Writer, "Invalid team", http.StatusBadRequest)
+		return
+	}
+
+	err = env.db.Unscoped().Where("board_id = ? AND team_id = ?", board.ID, teamId).Delete(&BoardTeamGrant{}).Error
+	if err != nil {
+		log.Printf("Could not revoke team %d access to board %d: %v", teamId, board.ID, err)
+		http.Error(c.Writer, "Could not remove team from board", http.StatusInternalServerError)
+		return
+	}
+	env.teamBoardAccessChanged(uint(teamId), board.ID)
+	log.Printf("Team %d no longer has access to board %d", teamId, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+// teamBoardAccessChanged refreshes the access of everyone in the team after
+// its grant on the board changed.
+func (env *Env) teamBoardAccessChanged(teamId uint, boardId uint) {
+	userIds := []uint{}
+	env.db.Model(&TeamMember{}).Where("team_id = ?", teamId).Pluck("user_id", &userIds)
+	for _, userId := range userIds {
+		env.membershipChanged(boardId, userId)
+	}
+}
+
+// teamMembershipChanged refreshes the user's access to every board the team
+// has been granted after they joined or left it.
+func (env *Env) teamMembershipChanged(teamId uint, userId uint) {
+	boardIds := []uint{}
+	env.db.Model(&BoardTeamGrant{}).Where("team_id = ?", teamId).Pluck("board_id", &boardIds)
+	for _, boardId := range boardIds {
+		env.membershipChanged(boardId, userId)
+	}
+}
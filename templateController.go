@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// templateRow is a template as listed on the new board page.
+type templateRow struct {
+	ID        uint
+	BoardName string
+	// Empty for personal templates
+	TeamName string
+}
+
+// templateRole is the role a member effectively has on board: nobody but
+// owners can change a template.
+func templateRole(board Board, role string) string {
+	if board.IsTemplate && role != RoleOwner && role != "" {
+		return RoleViewer
+	}
+	return role
+}
+
+// visibleTemplates finds the templates the user can start boards from: their
+// own and ones shared with a team they're in.
+func (env *Env) visibleTemplates(user User) *gorm.DB {
+	userTeamIds := env.db.Model(&TeamMember{}).Select("team_id").Where("user_id = ?", user.ID)
+	return env.db.Model(&Board{}).
+		Where("boards.is_template").
+		Where("boards.id IN (?) OR boards.template_team_id IN (?)", env.accessibleBoardIds(user), userTeamIds)
+}
+
+func (env *Env) templatesForUser(user User) []templateRow {
+	rows := []templateRow{}
+	env.visibleTemplates(user).
+		Select("boards.id, boards.board_name, teams.name AS team_name").
+		Joins("LEFT JOIN teams ON teams.id = boards.template_team_id").
+		Order("boards.board_name").
+		Scan(&rows)
+	return rows
+}
+
+// MakeBoardTemplate turns the board into a template, just for the owner or
+// for everyone in one of their teams if teamId is given.
+func (env *Env) MakeBoardTemplate(c *gin.Context) {
+	board := currentBoard(c)
+	user := currentUser(c)
+
+	var teamId *uint
+	if rawTeamId := c.PostForm("teamId"); rawTeamId != "" {
+		parsedTeamId, err := strconv.Atoi(rawTeamId)
+		if err != nil {
+			http.Error(c.Writer, "Invalid team", http.StatusBadRequest)
+			return
+		}
+		var inTeam int64
+		env.db.Model(&TeamMember{}).Where("team_id = ? AND user_id = ?", parsedTeamId, user.ID).Count(&inTeam)
+		if inTeam == 0 {
+			http.Error(c.Writer, "You can only share templates with teams you're in", http.StatusForbidden)
+			return
+		}
+		id := uint(parsedTeamId)
+		teamId = &id
+	}
+
+	err := env.db.Model(&board).Updates(map[string]interface{}{"is_template": true, "template_team_id": teamId}).Error
+	if err != nil {
+		log.Printf("Could not make board %d a template: %v", board.ID, err)
+		http.Error(c.Writer, "Could not make board a template", http.StatusInternalServerError)
+		return
+	}
+	env.templateChanged(board)
+	log.Printf("User %d made board %d a template", user.ID, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+func (env *Env) UnmakeBoardTemplate(c *gin.Context) {
+	board := currentBoard(c)
+
+	err := env.db.Model(&board).Updates(map[string]interface{}{"is_template": false, "template_team_id": nil}).Error
+	if err != nil {
+		log.Printf("Could not stop board %d being a template: %v", board.ID, err)
+		http.Error(c.Writer, "Could not stop board being a template", http.StatusInternalServerError)
+		return
+	}
+	env.templateChanged(board)
+	log.Printf("Board %d is no longer a template", board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+// templateChanged updates whether everyone with access to the board can draw
+// on it after it became, or stopped being, a template.
+func (env *Env) templateChanged(board Board) {
+	userIds := []uint{}
+	env.db.Raw("? UNION ?",
+		env.db.Model(&BoardMember{}).Select("user_id").Where("board_id = ?", board.ID),
+		env.db.Model(&TeamMember{}).Select("team_members.user_id").
+			Joins("JOIN board_team_grants ON board_team_grants.team_id = team_members.team_id AND board_team_grants.deleted_at IS NULL").
+			Where("board_team_grants.board_id = ?", board.ID),
+	).Scan(&userIds)
+	for _, userId := range userIds {
+		env.membershipChanged(board.ID, userId)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultBoardRetention = 30 * 24 * time.Hour
+	purgeInterval         = time.Hour
+)
+
+// boardRetentionFromEnv reads how long deleted boards stay in the trash from
+// BOARD_RETENTION_DAYS.
+func boardRetentionFromEnv() time.Duration {
+	days := os.Getenv("BOARD_RETENTION_DAYS")
+	if days == "" {
+		return defaultBoardRetention
+	}
+	parsedDays, err := strconv.Atoi(days)
+	if err != nil || parsedDays < 1 {
+		log.Printf("Invalid BOARD_RETENTION_DAYS %s, using the default", days)
+		return defaultBoardRetention
+	}
+	return time.Duration(parsedDays) * 24 * time.Hour
+}
+
+// boardScopedModels are the models with a board_id that belong to a board.
+// DeleteBoard, RestoreBoard and purgeDeletedBoards all go through this list,
+// so new ones only need adding here. Models with a DeletedAt go in the trash
+// along with the board, the rest are kept until the board is purged.
+var boardScopedModels = []interface{}{
+	&Line{},
+	&BoardMember{},
+	&BoardInviteLink{},
+	&BoardTeamGrant{},
+	&BoardInvitation{},
+	&AccessRequest{},
+	&FavouriteBoard{},
+	&BoardVisit{},
+	&BoardFolder{},
+	&BoardTag{},
+}
+
+// softDeletable reports whether model has a DeletedAt, so it can be put in
+// the trash.
+func softDeletable(tx *gorm.DB, model interface{}) (bool, error) {
+	statement := &gorm.Statement{DB: tx}
+	err := statement.Parse(model)
+	if err != nil {
+		return false, err
+	}
+	return statement.Schema.LookUpField("DeletedAt") != nil, nil
+}
+
+// trashedBoardRow is a deleted board as listed in the trash.
+type trashedBoardRow struct {
+	ID        uint
+	BoardName string
+	DeletedAt time.Time
+}
+
+// ownedDeletedBoards finds deleted boards the user owned when they were
+// deleted.
+func (env *Env) ownedDeletedBoards(user User) *gorm.DB {
+	return env.db.Unscoped().Table("boards").
+		Joins("JOIN board_members ON board_members.board_id = boards.id").
+		Where("boards.deleted_at IS NOT NULL AND board_members.deleted_at = boards.deleted_at").
+		Where("board_members.user_id = ? AND board_members.role = ?", user.ID, RoleOwner)
+}
+
+func (env *Env) GetTrash(c *gin.Context) {
+	user := currentUser(c)
+
+	boards := []trashedBoardRow{}
+	env.ownedDeletedBoards(user).Select("boards.id, boards.board_name, boards.deleted_at").Order("boards.deleted_at desc").Find(&boards)
+
+	templateVars := map[string]interface{}{"boards": boards, "retentionDays": int(env.boardRetention.Hours() / 24)}
+	err := templates.ExecuteTemplate(c.Writer, "trash.html", templateVars)
+
+	if err != nil {
+		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// RestoreBoard undoes DeleteBoard. Only rows deleted along with the board are
+// brought back, not invite links that were revoked beforehand.
+func (env *Env) RestoreBoard(c *gin.Context) {
+	user := currentUser(c)
+	boardId := c.Params.ByName("boardId")
+
+	board := Board{}
+	err := env.ownedDeletedBoards(user).Select("boards.*").Where("boards.id = ?", boardId).First(&board).Error
+	if err != nil {
+		http.Error(c.Writer, "Board not found in your trash", http.StatusNotFound)
+		return
+	}
+
+	deletedAt := board.DeletedAt.Time
+	err = env.db.Transaction(func(tx *gorm.DB) error {
+		// Locked first, like DeleteBoard
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&Board{}, board.ID).Error; err != nil {
+			return err
+		}
+		for _, model := range boardScopedModels {
+			softDelete, err := softDeletable(tx, model)
+			if err != nil {
+				return err
+			}
+			if !softDelete {
+				continue
+			}
+			if err := tx.Unscoped().Model(model).Where("board_id = ? AND deleted_at = ?", board.ID, deletedAt).Update("deleted_at", nil).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Unscoped().Model(&board).Update("deleted_at", nil).Error
+	})
+	if err != nil {
+		log.Printf("Could not restore board %d: %v", board.ID, err)
+		http.Error(c.Writer, "Could not restore board", http.StatusInternalServerError)
+		return
+	}
+
+	env.memberships.invalidateBoard(board.ID)
+	log.Printf("User %d restored board %d", user.ID, board.ID)
+	c.Redirect(http.StatusFound, fmt.Sprintf("/board/%d", board.ID))
+}
+
+// purgeDeletedBoards permanently removes boards that have been in the trash
+// for longer than the retention period, checking every purgeInterval.
+func (env *Env) purgeDeletedBoards() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().Add(-env.boardRetention)
+		err := env.db.Transaction(func(tx *gorm.DB) error {
+			expiredBoards := tx.Unscoped().Model(&Board{}).Select("id").Where("deleted_at < ?", cutoff)
+			for _, model := range boardScopedModels {
+				if err := tx.Unscoped().Where("board_id IN (?)", expiredBoards).Delete(model).Error; err != nil {
+					return err
+				}
+			}
+			result := tx.Unscoped().Where("deleted_at < ?", cutoff).Delete(&Board{})
+			if result.RowsAffected > 0 {
+				log.Printf("Purged %d deleted boards", result.RowsAffected)
+			}
+			return result.Error
+		})
+		if err != nil {
+			log.Printf("Could not purge deleted boards: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -37,9 +36,7 @@ func (env *Env) CreateUser(c *gin.Context) {
 		return
 	}
 
-	// TODO: handle this error
-	sessionId, err := getSessionIdFromCookie(c)
-	user, err := env.getUserFromSession(sessionId)
+	user, err := env.userFromRequest(c)
 	if err == nil {
 		userUrl := fmt.Sprintf("/user/%d", user.ID)
 		c.Redirect(http.StatusFound, userUrl)
@@ -58,29 +55,25 @@ func (env *Env) CreateUser(c *gin.Context) {
 	}
 	log.Printf("New user created: %s", user.Username)
 
-	sessionId = uuid.New()
-	env.sessions[sessionId] = username
-	c.SetCookie("sessionId", sessionId.String(), 0, "/", c.Request.Host, false, false)
+	session := newSession(username)
+	err = env.sessions.Set(session)
+	if err != nil {
+		log.Printf("Could not create session for %s: %v", username, err)
+		http.Error(c.Writer, "Could not sign in", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(c, session)
 
 	userUrl := fmt.Sprintf("/user/%d", user.ID)
 	c.Redirect(http.StatusFound, userUrl)
 }
 
 func (env *Env) NewUser(c *gin.Context) {
-	cookie, err := c.Cookie("sessionId")
-
-	if err != nil {
-		log.Println("No existing session id from cookies")
-	} else {
-		log.Printf("Got cookie %s", cookie)
-		sessionId, _ := uuid.Parse(cookie)
-		user, err := env.getUserFromSession(sessionId)
-		if err == nil {
-			userUrl := fmt.Sprintf("/user/%d", user.ID)
-			c.Redirect(http.StatusFound, userUrl)
-			return
-		}
-		log.Printf("Could not find valid session for %s", cookie)
+	user, err := env.userFromRequest(c)
+	if err == nil {
+		userUrl := fmt.Sprintf("/user/%d", user.ID)
+		c.Redirect(http.StatusFound, userUrl)
+		return
 	}
 	err = templates.ExecuteTemplate(c.Writer, "newUser.html", nil)
 
@@ -129,32 +122,48 @@ func (env *Env) SignInUser(c *gin.Context) {
 	}
 	log.Println("Success logging in")
 
-	sessionId := uuid.New()
-	env.sessions[sessionId] = username
-
+	session := newSession(username)
+	err = env.sessions.Set(session)
+	if err != nil {
+		log.Printf("Could not create session for %s: %v", username, err)
+		http.Error(c.Writer, "Could not sign in", http.StatusInternalServerError)
+		return
+	}
 
-	c.SetCookie("sessionId", sessionId.String(), 0, "/", c.Request.Host, false, false)
+	setSessionCookie(c, session)
 	c.Redirect(http.StatusFound, fmt.Sprintf("/user/%d", user.ID))
 }
 
-func (env *Env) GetUser(c *gin.Context) {
+func (env *Env) SignOutUser(c *gin.Context) {
 	sessionId, err := getSessionIdFromCookie(c)
-	user, err := env.getUserFromSession(sessionId)
-	if err != nil {
-		err = templates.ExecuteTemplate(c.Writer, "signIn.html", nil)
-
+	if err == nil {
+		err = env.sessions.Delete(sessionId)
 		if err != nil {
-			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
+			log.Printf("Could not delete session %s: %v", sessionId.String(), err)
 		}
-		return
 	}
+	clearSessionCookie(c)
+	c.Redirect(http.StatusFound, "/signin")
+}
+
+func setSessionCookie(c *gin.Context, session Session) {
+	maxAge := int(sessionAbsoluteTimeout.Seconds())
+	c.SetCookie("sessionId", session.Id.String(), maxAge, "/", c.Request.Host, false, false)
+}
+
+func clearSessionCookie(c *gin.Context) {
+	c.SetCookie("sessionId", "", -1, "/", c.Request.Host, false, false)
+}
+
+func (env *Env) GetUser(c *gin.Context) {
+	user := currentUser(c)
 
 	userId := c.Params.ByName("userId")
 
 	// TODO: Error check this conversion
 	userIdConv, _ := strconv.Atoi(userId)
 	if user.ID != uint(userIdConv){
-		err = templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
+		err := templates.ExecuteTemplate(c.Writer, "notAuthorized.html", nil)
 
 		if err != nil {
 			http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
@@ -167,7 +176,8 @@ func (env *Env) GetUser(c *gin.Context) {
 	log.Printf("User %s id %d\n", user.Username, user.ID)
 	log.Printf("=========================")
 
-	err = templates.ExecuteTemplate(c.Writer, "user.html", user)
+	templateVars := map[string]interface{}{"user": user, "invitations": env.pendingInvitationsForUser(user)}
+	err := templates.ExecuteTemplate(c.Writer, "user.html", templateVars)
 
 	if err != nil {
 		http.Error(c.Writer, err.Error(), http.StatusInternalServerError)
@@ -175,20 +185,11 @@ func (env *Env) GetUser(c *gin.Context) {
 }
 
 func (env *Env) SignInPage(c *gin.Context) {
-	cookie, err := c.Cookie("sessionId")
-
-	if err != nil {
-		log.Println("No existing session id from cookies")
-	} else {
-		log.Printf("Got cookie %s", cookie)
-		sessionId, _ := uuid.Parse(cookie)
-		user, err := env.getUserFromSession(sessionId)
-		if err == nil {
-			userUrl := fmt.Sprintf("/user/%d", user.ID)
-			c.Redirect(http.StatusFound, userUrl)
-			return
-		}
-		log.Printf("Could not find valid session for %s", cookie)
+	user, err := env.userFromRequest(c)
+	if err == nil {
+		userUrl := fmt.Sprintf("/user/%d", user.ID)
+		c.Redirect(http.StatusFound, userUrl)
+		return
 	}
 	err = templates.ExecuteTemplate(c.Writer, "signIn.html", nil)
 